@@ -5,10 +5,17 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	pgxv5 "github.com/jackc/pgx/v5"
+	"github.com/jmoiron/sqlx"
 	"github.com/ooqls/go-log"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -26,32 +33,80 @@ func init() {
 	flag.IntVar(&docsPortFlag, "docs-port", 8080, "Port to serve docs on")
 	flag.StringVar(&docsPathFlag, "docs-path", "/docs/", "Path to the docs directory")
 	flag.StringVar(&docsApiPathFlag, "docs-api-path", "/api/docs", "Path to the docs API")
+	flag.Var(&configFilesFlag, "config", "Path to a config file, can be repeated")
+	flag.Var(&configSetFlag, "set", "Config value as key=value, e.g. gin.port=8080, can be repeated")
 }
 
-func New(appName string, features Features) *app {
-	return &app{
-		appName:    appName,
-		l:          log.NewLogger(appName),
-		features:   features,
-		threadWg:   &sync.WaitGroup{},
-		httpClient: http.DefaultClient,
+func New(appName string, features Features, opts ...appOpt) *app {
+	a := &app{
+		appName:             appName,
+		l:                   log.NewLogger(appName),
+		features:            features,
+		state:               newAppState(),
+		threadWg:            &sync.WaitGroup{},
+		httpClient:          http.DefaultClient,
+		servers:             map[string]*http.Server{},
+		serveErrs:           make(chan error, 1),
+		stopTimeout:         defaultStopTimeout,
+		stopTimeouts:        map[string]time.Duration{},
+		healthInterval:      make(chan time.Duration, 1),
+		configWatchInterval: defaultConfigWatchInterval,
 	}
+
+	for _, opt := range opts {
+		a.apply(opt)
+	}
+
+	return a
 }
 
 type app struct {
-	appName         string
-	setup           func(ctx *AppContext) error
-	running         func(ctx *AppContext) error
-	stopped         func(ctx *AppContext) error
-	healthCheck     func() bool
-	onPanic         func(err interface{})
-	l               *zap.Logger
-	state           AppState
-	features        Features
-	testEnvironment *TestEnvironment
-	httpClient      *http.Client
-	stopServers     []func() (string, error)
-	threadWg        *sync.WaitGroup
+	appName             string
+	setup               func(ctx *AppContext) error
+	running             func(ctx *AppContext) error
+	stopped             func(ctx *AppContext) error
+	reload              func(ctx *AppContext) error
+	healthCheck         func() bool
+	onPanic             func(err interface{})
+	l                   *zap.Logger
+	state               *appState
+	features            Features
+	testEnvironment     *TestEnvironment
+	httpClient          *http.Client
+	servers             map[string]*http.Server
+	serveErrs           chan error
+	stopTimeout         time.Duration
+	stopTimeouts        map[string]time.Duration
+	threadWg            *sync.WaitGroup
+	handleSignals       bool
+	startupDone         atomic.Bool
+	healthM             sync.RWMutex
+	healthChecks        []*healthCheck
+	healthReport        atomic.Pointer[HealthReport]
+	ready               atomic.Bool
+	appCtxM             sync.RWMutex
+	appCtx              *AppContext
+	sqlM                sync.Mutex
+	sqlxDB              *sqlx.DB
+	pgxConn             *pgxv5.Conn
+	sqlSeedErr          error
+	httpMiddleware      []httpMiddleware
+	clientMiddleware    []clientMiddleware
+	cors                atomic.Pointer[gin.HandlerFunc]
+	healthInterval      chan time.Duration
+	configLoader        *ConfigLoader
+	config              *AppConfig
+	configM             sync.Mutex
+	configWatchInterval time.Duration
+	stopConfigWatch     func()
+	certs               *certReloader
+	stopCertWatch       func()
+	tracerProvider      *sdktrace.TracerProvider
+	tracingFile         *os.File
+	startupSpan         trace.Span
+	registered          []Feature
+	startedM            sync.Mutex
+	started             []Feature
 }
 
 func (a *app) WithTestEnvironment(env TestEnvironment) {
@@ -59,17 +114,23 @@ func (a *app) WithTestEnvironment(env TestEnvironment) {
 }
 
 func (a *app) IsRunning() bool {
-	return a.state.Running
+	return a.state.phase() == PhaseRunning
 }
 
-func (a *app) OnStartup(f func(ctx *AppContext) error) *app {
-	a.setup = func(ctx *AppContext) error {
-		if a.features.Gin.Enabled {
-			a.features.Gin.Engine.Use(cors.New(*a.features.Gin.Cors))
-		}
+// State returns a snapshot of the current state of the app.
+func (a *app) State() AppState {
+	return a.state.snapshot()
+}
 
-		return f(ctx)
-	}
+// Subscribe returns a channel that receives the lifecycle events of the app.
+// The channel is closed once the app stopped or failed. Events are dropped
+// when the channel is not read fast enough.
+func (a *app) Subscribe() <-chan LifecycleEvent {
+	return a.state.subscribe()
+}
+
+func (a *app) OnStartup(f func(ctx *AppContext) error) *app {
+	a.setup = f
 	return a
 }
 
@@ -78,13 +139,36 @@ func (a *app) OnRunning(f func(ctx *AppContext) error) *app {
 	return a
 }
 
+// OnPanic sets the hook that is called with every panic the app recovers
+// from, in handlers of the gin engine and the http mux, on startup and in the
+// running hook.
+func (a *app) OnPanic(f func(err interface{})) *app {
+	a.onPanic = f
+	return a
+}
+
 func (a *app) OnStopped(f func(ctx *AppContext) error) *app {
 	a.stopped = f
 	return a
 }
 
+// Register adds a feature that is started together with the built-in features.
+func (a *app) Register(f Feature) *app {
+	a.registered = append(a.registered, f)
+	return a
+}
+
+// OnReload sets a hook that is called when the app receives SIGHUP.
+func (a *app) OnReload(f func(ctx *AppContext) error) *app {
+	a.reload = f
+	return a
+}
+
+// IsHealthy reports whether no critical health check failed on the last evaluation.
+// It does not run the checks, the app is not healthy before they first ran.
 func (a *app) IsHealthy() bool {
-	return a.state.Healthy
+	report := a.healthReport.Load()
+	return report != nil && report.Status != HealthStatusError
 }
 
 func (a *app) SetHealthCheck(f func() bool) *app {
@@ -94,6 +178,12 @@ func (a *app) SetHealthCheck(f func() bool) *app {
 
 func (a *app) Run(ctx context.Context) error {
 	flag.Parse()
+	if a.handleSignals {
+		var stop func()
+		ctx, stop = a._handle_signals(ctx)
+		defer stop()
+	}
+
 	if a.testEnvironment != nil {
 		cleanup, err := a.testEnvironment.Start(context.Background())
 		if err != nil {
@@ -0,0 +1,156 @@
+package app
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx that carries l.
+func WithLogger(ctx context.Context, l *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFromContext returns the request scoped logger of ctx, ctx can be the
+// context of a request or a *gin.Context. The global zap logger is returned
+// when ctx has no logger.
+func LoggerFromContext(ctx context.Context) *zap.Logger {
+	if c, ok := ctx.(*gin.Context); ok && c.Request != nil {
+		ctx = c.Request.Context()
+	}
+
+	return loggerFromContext(ctx, zap.L())
+}
+
+func loggerFromContext(ctx context.Context, fallback *zap.Logger) *zap.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return l
+	}
+
+	return fallback
+}
+
+// accessLog logs the requests served by the gin engine and the http mux.
+type accessLog struct {
+	l          *zap.Logger
+	sampleRate float64
+	exclude    map[string]bool
+}
+
+func (a *accessLog) excluded(path string) bool {
+	return a.exclude[path]
+}
+
+// requestLogger returns the logger of a single request, it extends the
+// logger with the request ID when there is one.
+func (a *accessLog) requestLogger(server string, r *http.Request) *zap.Logger {
+	fields := []zap.Field{
+		zap.String("server", server),
+		zap.String("method", r.Method),
+		zap.String("path", r.URL.Path),
+	}
+	if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+		fields = append(fields, zap.String("trace_id", sc.TraceID().String()))
+	}
+
+	return loggerFromContext(r.Context(), a.l).With(fields...)
+}
+
+func (a *accessLog) log(l *zap.Logger, route string, status, bytes int, clientIP string, d time.Duration) {
+	if status < http.StatusInternalServerError && a.sampleRate < 1 && rand.Float64() >= a.sampleRate {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("route", route),
+		zap.Int("status", status),
+		zap.Duration("latency", d),
+		zap.Int("bytes", bytes),
+		zap.String("client_ip", clientIP),
+	}
+	if status >= http.StatusInternalServerError {
+		l.Error("request", fields...)
+		return
+	}
+	l.Info("request", fields...)
+}
+
+func (a *accessLog) ginMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a.excluded(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		l := a.requestLogger(GinFeatureName, c.Request)
+		c.Request = c.Request.WithContext(WithLogger(c.Request.Context(), l))
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		a.log(l, route, c.Writer.Status(), c.Writer.Size(), c.ClientIP(), time.Since(start))
+	}
+}
+
+func (a *accessLog) httpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.excluded(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		l := a.requestLogger(HTTPFeatureName, r)
+		rec := newResponseRecorder(w)
+		serveWithContext(next, rec, r, WithLogger(r.Context(), l))
+
+		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientIP = r.RemoteAddr
+		}
+		a.log(l, routePattern(r), rec.Status(), rec.bytes, clientIP, time.Since(start))
+	})
+}
+
+func (a *app) _startup_access_log(ctx *AppContext) error {
+	l := a.l
+	f := a.features.AccessLog
+
+	exclude := map[string]bool{}
+	for _, path := range f.ExcludePaths {
+		exclude[path] = true
+	}
+
+	if f.ExcludeHealth && a.features.Health.Enabled {
+		h := a.features.Health
+		for _, path := range []string{h.Path, h.LivenessPath, h.ReadinessPath, h.StartupPath} {
+			if path != "" {
+				exclude[path] = true
+			}
+		}
+	}
+
+	al := &accessLog{l: a.l, sampleRate: f.SampleRate, exclude: exclude}
+	if a.features.Gin.Enabled {
+		l.Debug("[Startup Access Log] logging gin requests")
+		a.features.Gin.Engine.Use(al.ginMiddleware())
+	}
+
+	if a.features.HTTP.Enabled {
+		l.Debug("[Startup Access Log] logging http requests")
+		a._use_http(al.httpMiddleware)
+	}
+
+	return nil
+}
@@ -0,0 +1,412 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwtv5 "github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/ooqls/go-crypto/jwt"
+	"go.uber.org/zap"
+)
+
+// maxAuthRequestSize is the size above which the body of a token request is
+// not read.
+const maxAuthRequestSize = 1 << 16
+
+// refreshTokenSweepInterval is how often the memory store drops expired tokens.
+const refreshTokenSweepInterval = time.Minute
+
+// ErrRefreshTokenRevoked is returned by RefreshTokenStore.Save for a token of
+// a revoked family.
+var ErrRefreshTokenRevoked = errors.New("refresh token family was revoked")
+
+// RefreshToken is a refresh token issued by the auth feature.
+type RefreshToken struct {
+	// ID is the jti claim of the token.
+	ID string
+	// Family is shared by the tokens rotated from the same login.
+	Family    string
+	Subject   string
+	ExpiresAt time.Time
+	Used      bool
+	Revoked   bool
+}
+
+// RefreshTokenStore tracks the issued refresh tokens. A token can only be
+// used once, using it again revokes its family.
+type RefreshTokenStore interface {
+	// Save stores a newly issued token. It returns ErrRefreshTokenRevoked
+	// when the family of t was revoked, so a rotation that races the reuse
+	// of a token can not keep the family alive.
+	Save(ctx context.Context, t RefreshToken) error
+	// Get returns the token with id, ok is false for unknown tokens.
+	Get(ctx context.Context, id string) (t RefreshToken, ok bool, err error)
+	// Use marks the token with id as used and returns it as it was before,
+	// ok is false for unknown tokens. It has to be atomic.
+	Use(ctx context.Context, id string) (t RefreshToken, ok bool, err error)
+	// RevokeFamily revokes every token of family, including the ones saved
+	// later.
+	RevokeFamily(ctx context.Context, family string) error
+}
+
+type memoryRefreshTokenStore struct {
+	m      sync.Mutex
+	tokens map[string]RefreshToken
+	// revoked holds the revoked families until their last token expired.
+	revoked map[string]time.Time
+	swept   time.Time
+}
+
+// NewMemoryRefreshTokenStore returns a store that keeps the tokens in memory,
+// expired tokens are dropped at most once a minute when new ones are saved.
+func NewMemoryRefreshTokenStore() RefreshTokenStore {
+	return &memoryRefreshTokenStore{
+		tokens:  map[string]RefreshToken{},
+		revoked: map[string]time.Time{},
+		swept:   time.Now(),
+	}
+}
+
+func (s *memoryRefreshTokenStore) Save(ctx context.Context, t RefreshToken) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.swept) >= refreshTokenSweepInterval {
+		s.sweep(now)
+	}
+
+	if _, ok := s.revoked[t.Family]; ok {
+		return ErrRefreshTokenRevoked
+	}
+	s.tokens[t.ID] = t
+
+	return nil
+}
+
+// sweep drops the expired tokens and revoked families.
+func (s *memoryRefreshTokenStore) sweep(now time.Time) {
+	for id, token := range s.tokens {
+		if now.After(token.ExpiresAt) {
+			delete(s.tokens, id)
+		}
+	}
+	for family, expiresAt := range s.revoked {
+		if now.After(expiresAt) {
+			delete(s.revoked, family)
+		}
+	}
+	s.swept = now
+}
+
+func (s *memoryRefreshTokenStore) Get(ctx context.Context, id string) (RefreshToken, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	t, ok := s.tokens[id]
+	return t, ok, nil
+}
+
+func (s *memoryRefreshTokenStore) Use(ctx context.Context, id string) (RefreshToken, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	t, ok := s.tokens[id]
+	if ok {
+		used := t
+		used.Used = true
+		s.tokens[id] = used
+	}
+	if _, revoked := s.revoked[t.Family]; ok && revoked {
+		t.Revoked = true
+	}
+
+	return t, ok, nil
+}
+
+func (s *memoryRefreshTokenStore) RevokeFamily(ctx context.Context, family string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	expiresAt := time.Now()
+	for id, t := range s.tokens {
+		if t.Family == family {
+			t.Revoked = true
+			s.tokens[id] = t
+			if t.ExpiresAt.After(expiresAt) {
+				expiresAt = t.ExpiresAt
+			}
+		}
+	}
+	s.revoked[family] = expiresAt
+
+	return nil
+}
+
+// TokenResponse is the response of the login and the refresh route.
+type TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+}
+
+// refreshTokenRequest is the body of the refresh and the revoke route.
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// issueJWT signs a token of the issuer of cfg for subject.
+func (ctx *AppContext) issueJWT(cfg *jwt.TokenConfiguration, subject string) (string, *JWTClaims, error) {
+	now := time.Now()
+	claims := &JWTClaims{RegisteredClaims: jwtv5.RegisteredClaims{
+		ID:        cfg.GenerateId(),
+		Issuer:    cfg.Issuer,
+		Subject:   subject,
+		Audience:  cfg.Audience,
+		ExpiresAt: jwtv5.NewNumericDate(now.Add(time.Duration(cfg.ValidityDurationSeconds * float64(time.Second)))),
+		NotBefore: jwtv5.NewNumericDate(now),
+		IssuedAt:  jwtv5.NewNumericDate(now),
+	}}
+
+	token, err := ctx.signJWT(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, claims, nil
+}
+
+// _auth_issue issues an access token and a refresh token of family for subject.
+func (a *app) _auth_issue(ctx *AppContext, r *http.Request, subject, family string) (*TokenResponse, error) {
+	authCfg, ok := ctx.AuthIssuerConfig()
+	if !ok {
+		return nil, fmt.Errorf("no token configuration for issuer %s", AuthIssuer)
+	}
+	refreshCfg, ok := ctx.RefreshIssuerConfig()
+	if !ok {
+		return nil, fmt.Errorf("no token configuration for issuer %s", RefreshIssuer)
+	}
+
+	access, _, err := ctx.issueJWT(authCfg, subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue access token: %v", err)
+	}
+
+	refresh, claims, err := ctx.issueJWT(refreshCfg, subject)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue refresh token: %v", err)
+	}
+
+	err = a.features.Auth.Store.Save(r.Context(), RefreshToken{
+		ID:        claims.ID,
+		Family:    family,
+		Subject:   subject,
+		ExpiresAt: claims.ExpiresAt.Time,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save refresh token: %w", err)
+	}
+
+	return &TokenResponse{
+		AccessToken:      access,
+		TokenType:        "Bearer",
+		ExpiresIn:        int64(authCfg.ValidityDurationSeconds),
+		RefreshToken:     refresh,
+		RefreshExpiresIn: int64(refreshCfg.ValidityDurationSeconds),
+	}, nil
+}
+
+// _auth_respond writes the issued tokens, or a 500 problem when they could
+// not be issued.
+func (a *app) _auth_respond(w http.ResponseWriter, r *http.Request, resp *TokenResponse, err error) {
+	if err != nil {
+		loggerFromContext(r.Context(), a.l).Error("[Auth] failed to issue tokens", zap.Error(err))
+		WriteProblem(w, NewProblem(r, http.StatusInternalServerError, "the server could not issue tokens"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// _auth_login exchanges the credentials of the request for tokens of a new family.
+func (a *app) _auth_login(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var c Credentials
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxAuthRequestSize)).Decode(&c); err != nil {
+			WriteProblem(w, NewProblem(r, http.StatusBadRequest, "the body has to be json with a username and a password"))
+			return
+		}
+
+		subject, err := a.features.Auth.Validator.ValidateCredentials(r.Context(), c)
+		if errors.Is(err, ErrInvalidCredentials) {
+			writeAuthProblem(w, NewProblem(r, http.StatusUnauthorized, "the credentials are invalid"))
+			return
+		}
+		if err != nil {
+			loggerFromContext(r.Context(), a.l).Error("[Auth] failed to validate credentials", zap.Error(err))
+			WriteProblem(w, NewProblem(r, http.StatusInternalServerError, "the server could not validate the credentials"))
+			return
+		}
+
+		resp, err := a._auth_issue(ctx, r, subject, uuid.NewString())
+		a._auth_respond(w, r, resp, err)
+	}
+}
+
+// _auth_refresh_token returns the refresh token of the body of the request,
+// or answers the request when there is none.
+func (a *app) _auth_refresh_token(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req refreshTokenRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxAuthRequestSize)).Decode(&req); err != nil || req.RefreshToken == "" {
+		WriteProblem(w, NewProblem(r, http.StatusBadRequest, "the body has to be json with a refresh_token"))
+		return "", false
+	}
+
+	return req.RefreshToken, true
+}
+
+// _auth_parse_refresh returns the claims of a refresh token signed with the
+// JWT key by the refresh issuer.
+func (a *app) _auth_parse_refresh(ctx *AppContext, token string) (*JWTClaims, error) {
+	cfg, ok := ctx.RefreshIssuerConfig()
+	if !ok {
+		return nil, fmt.Errorf("no token configuration for issuer %s", RefreshIssuer)
+	}
+
+	return ctx.parseJWT(token, cfg, nil, 0)
+}
+
+// _auth_refresh rotates a refresh token, the used token is spent and a new
+// one of the same family is issued with the access token. A spent token that
+// is used again revokes its family, as either the client or an attacker
+// holds a stolen copy.
+func (a *app) _auth_refresh(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := loggerFromContext(r.Context(), a.l)
+		token, ok := a._auth_refresh_token(w, r)
+		if !ok {
+			return
+		}
+
+		claims, err := a._auth_parse_refresh(ctx, token)
+		if err != nil {
+			l.Debug("[Auth] rejected refresh token", zap.Error(err))
+			writeAuthProblem(w, NewProblem(r, http.StatusUnauthorized, jwtErrorDetail(err, RefreshIssuer)))
+			return
+		}
+
+		store := a.features.Auth.Store
+		t, ok, err := store.Use(r.Context(), claims.ID)
+		if err != nil {
+			a._auth_respond(w, r, nil, fmt.Errorf("failed to use refresh token: %v", err))
+			return
+		}
+
+		switch {
+		case !ok:
+			writeAuthProblem(w, NewProblem(r, http.StatusUnauthorized, "the refresh token is unknown"))
+			return
+		case t.Revoked:
+			writeAuthProblem(w, NewProblem(r, http.StatusUnauthorized, "the refresh token was revoked"))
+			return
+		case t.Used:
+			l.Warn("[Auth] refresh token reused, revoking its family",
+				zap.String("subject", t.Subject), zap.String("family", t.Family))
+			if err := store.RevokeFamily(r.Context(), t.Family); err != nil {
+				l.Error("[Auth] failed to revoke refresh token family", zap.Error(err))
+			}
+			writeAuthProblem(w, NewProblem(r, http.StatusUnauthorized, "the refresh token was already used"))
+			return
+		}
+
+		resp, err := a._auth_issue(ctx, r, t.Subject, t.Family)
+		if errors.Is(err, ErrRefreshTokenRevoked) {
+			writeAuthProblem(w, NewProblem(r, http.StatusUnauthorized, "the refresh token was revoked"))
+			return
+		}
+		a._auth_respond(w, r, resp, err)
+	}
+}
+
+// _auth_revoke revokes the family of a refresh token. Like RFC 7009 it
+// answers 200 for tokens that are invalid or unknown.
+func (a *app) _auth_revoke(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := a._auth_refresh_token(w, r)
+		if !ok {
+			return
+		}
+
+		claims, err := a._auth_parse_refresh(ctx, token)
+		if err != nil {
+			loggerFromContext(r.Context(), a.l).Debug("[Auth] ignoring revocation of an invalid token", zap.Error(err))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		store := a.features.Auth.Store
+		t, ok, err := store.Get(r.Context(), claims.ID)
+		if err == nil && ok {
+			err = store.RevokeFamily(r.Context(), t.Family)
+		}
+		if err != nil {
+			loggerFromContext(r.Context(), a.l).Error("[Auth] failed to revoke refresh token", zap.Error(err))
+			WriteProblem(w, NewProblem(r, http.StatusInternalServerError, "the server could not revoke the token"))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// _handle_auth mounts h on the gin engine and the http mux.
+func (a *app) _handle_auth(path string, h http.HandlerFunc) {
+	if a.features.Gin.Enabled {
+		a.features.Gin.Engine.POST(path, gin.WrapF(h))
+	}
+
+	if a.features.HTTP.Enabled {
+		a.features.HTTP.Mux.HandleFunc(http.MethodPost+" "+path, h)
+	}
+}
+
+func (a *app) _startup_auth(ctx *AppContext) error {
+	l := ctx.L()
+	f := &a.features.Auth
+
+	if !a.features.Gin.Enabled && !a.features.HTTP.Enabled {
+		return fmt.Errorf("auth needs the gin or the http feature to serve its routes")
+	}
+
+	for _, issuer := range []string{AuthIssuer, RefreshIssuer} {
+		if _, ok := ctx.TokenConfig(issuer); !ok {
+			return fmt.Errorf("auth needs a token configuration for issuer %s", issuer)
+		}
+	}
+
+	if f.Store == nil {
+		f.Store = NewMemoryRefreshTokenStore()
+	}
+
+	l.Info("[Startup Auth] serving token routes", zap.String("path", f.Path))
+	a._handle_auth(f.Path+"/refresh", a._auth_refresh(ctx))
+	a._handle_auth(f.Path+"/revoke", a._auth_revoke(ctx))
+	if f.Validator != nil {
+		l.Debug("[Startup Auth] serving login", zap.String("path", f.Path))
+		a._handle_auth(f.Path, a._auth_login(ctx))
+	}
+
+	return nil
+}
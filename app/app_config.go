@@ -1,6 +1,7 @@
 package app
 
 import (
+	"fmt"
 	"os"
 	"time"
 
@@ -26,6 +27,46 @@ type TLSConfig struct {
 	CaPath   string `yaml:"ca_path"`
 	CertFile string `yaml:"cert_file"`
 	KeyFile  string `yaml:"key_file"`
+	// ReloadInterval is how often the files are checked for changes in seconds.
+	ReloadInterval int `yaml:"reload_interval"`
+	// ClientAuth is one of none, request, require or verify.
+	ClientAuth string `yaml:"client_auth"`
+	// ServerClientAuth overrides ClientAuth by server, e.g. logging-api: verify.
+	ServerClientAuth map[string]string `yaml:"server_client_auth"`
+	DevCerts         DevCertsConfig    `yaml:"dev_certs"`
+	ACME             ACMEConfig        `yaml:"acme"`
+}
+
+// ACMEConfig obtains the certificates from an ACME CA like Let's Encrypt.
+type ACMEConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	Domains      []string `yaml:"domains"`
+	Email        string   `yaml:"email"`
+	CacheDir     string   `yaml:"cache_dir"`
+	DirectoryURL string   `yaml:"directory_url"`
+	HTTPPort     int      `yaml:"http_port"`
+}
+
+// DevCertsConfig generates a development certificate when no cert_file and
+// key_file are given.
+type DevCertsConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Hosts   []string `yaml:"hosts"`
+	Dir     string   `yaml:"dir"`
+}
+
+// serverClientAuth returns the client auth modes by server.
+func (c *TLSConfig) serverClientAuth() map[string]ClientAuthMode {
+	if len(c.ServerClientAuth) == 0 {
+		return nil
+	}
+
+	modes := map[string]ClientAuthMode{}
+	for server, mode := range c.ServerClientAuth {
+		modes[server] = ClientAuthMode(mode)
+	}
+
+	return modes
 }
 
 type JWTConfig struct {
@@ -34,6 +75,25 @@ type JWTConfig struct {
 	RSAPubKeyPath           string                   `yaml:"rsa_pub_key_path"`
 	TokenConfigurationPaths []string                 `yaml:"token_configuration_paths"`
 	TokenConfigurations     []jwt.TokenConfiguration `yaml:"token_configurations"`
+	JWKSPath                string                   `yaml:"jwks_path"`
+	RemoteJWKS              []RemoteJWKS             `yaml:"remote_jwks"`
+	// JWKSRefreshInterval is in seconds.
+	JWKSRefreshInterval int      `yaml:"jwks_refresh_interval"`
+	KeyDir              string   `yaml:"key_dir"`
+	PreviousKeyPaths    []string `yaml:"previous_key_paths"`
+	// RotationInterval is in seconds, 0 disables rotation.
+	RotationInterval int  `yaml:"rotation_interval"`
+	MaxPreviousKeys  *int `yaml:"max_previous_keys"`
+}
+
+// maxPreviousKeys returns how many replaced signing keys keep verifying
+// tokens, 2 by default.
+func (c *JWTConfig) maxPreviousKeys() int {
+	if c.MaxPreviousKeys == nil {
+		return defaultMaxPreviousJWTKeys
+	}
+
+	return *c.MaxPreviousKeys
 }
 
 type SQLFilesConfig struct {
@@ -56,9 +116,12 @@ type LoggingAPIConfig struct {
 }
 
 type HealthConfig struct {
-	Enabled  bool   `yaml:"enabled"`
-	Path     string `yaml:"path"`
-	Interval int    `yaml:"interval"`
+	Enabled       bool   `yaml:"enabled"`
+	Path          string `yaml:"path"`
+	Interval      int    `yaml:"interval"`
+	LivenessPath  string `yaml:"liveness_path"`
+	ReadinessPath string `yaml:"readiness_path"`
+	StartupPath   string `yaml:"startup_path"`
 }
 
 type CorsConfig struct {
@@ -81,7 +144,7 @@ func (c *CorsConfig) CorsConfig() *cors.Config {
 	if !c.Enabled {
 		return nil
 	}
-	
+
 	return &cors.Config{
 		AllowAllOrigins:        c.AllowAllOrigins,
 		AllowOrigins:           c.AllowOrigins,
@@ -115,6 +178,66 @@ type RSAConfig struct {
 	PublicKeyPath  string `yaml:"public_key_path"`
 }
 
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Port    int    `yaml:"port"`
+	Path    string `yaml:"path"`
+}
+
+type TracingConfig struct {
+	Enabled     bool     `yaml:"enabled"`
+	Exporter    string   `yaml:"exporter"`
+	Endpoint    string   `yaml:"endpoint"`
+	Insecure    bool     `yaml:"insecure"`
+	File        string   `yaml:"file"`
+	SampleRatio *float64 `yaml:"sample_ratio"`
+	ServiceName string   `yaml:"service_name"`
+}
+
+// sampleRatio returns the configured sample ratio, every trace is sampled by default.
+func (c *TracingConfig) sampleRatio() float64 {
+	if c.SampleRatio == nil {
+		return 1
+	}
+
+	return *c.SampleRatio
+}
+
+type AccessLogConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	SampleRate    *float64 `yaml:"sample_rate"`
+	ExcludePaths  []string `yaml:"exclude_paths"`
+	ExcludeHealth *bool    `yaml:"exclude_health"`
+}
+
+// sampleRate returns the configured sample rate, every request is logged by default.
+func (c *AccessLogConfig) sampleRate() float64 {
+	if c.SampleRate == nil {
+		return 1
+	}
+
+	return *c.SampleRate
+}
+
+// excludeHealth returns whether the health endpoints are excluded, they are by default.
+func (c *AccessLogConfig) excludeHealth() bool {
+	if c.ExcludeHealth == nil {
+		return true
+	}
+
+	return *c.ExcludeHealth
+}
+
+type AuthConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"`
+}
+
+type LogConfig struct {
+	// Level is one of DEBUG, INFO, WARNING or ERROR.
+	Level string `yaml:"level"`
+}
+
 type AppConfig struct {
 	LoggingAPI   LoggingAPIConfig `yaml:"logging_api"`
 	Gin          GinConfig        `yaml:"gin"`
@@ -127,8 +250,22 @@ type AppConfig struct {
 	Health       HealthConfig     `yaml:"health"`
 	HTTP         HTTPConfig       `yaml:"http"`
 	RSA          RSAConfig        `yaml:"rsa"`
+	Metrics      MetricsConfig    `yaml:"metrics"`
+	Tracing      TracingConfig    `yaml:"tracing"`
+	AccessLog    AccessLogConfig  `yaml:"access_log"`
+	Log          LogConfig        `yaml:"log"`
+	Auth         AuthConfig       `yaml:"auth"`
+
+	// positions maps the keys of the config to where they were set, e.g.
+	// app_config.yaml:12, Validate reports problems with them.
+	positions map[string]string
+	// secrets holds the keys of the values resolved from secret references.
+	secrets map[string]bool
 }
 
+// LoadConfig reads the config from a yaml file, unknown keys are rejected.
+// Secret references like ${env:DB_PASSWORD} or ${file:/run/secrets/db} are
+// resolved with EnvSecretResolver and FileSecretResolver.
 func LoadConfig(path string) (*AppConfig, error) {
 	cfg := &AppConfig{}
 
@@ -137,9 +274,18 @@ func LoadConfig(path string) (*AppConfig, error) {
 		return nil, err
 	}
 
-	err = yaml.Unmarshal(b, cfg)
+	err = yaml.UnmarshalStrict(b, cfg)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	cfg.positions = map[string]string{}
+	for key, line := range yamlLines(b) {
+		cfg.positions[key] = fmt.Sprintf("%s:%d", path, line)
+	}
+
+	if err := cfg.resolveSecrets(defaultSecretResolvers()); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
 	}
 
 	return cfg, nil
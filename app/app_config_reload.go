@@ -0,0 +1,264 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ooqls/go-crypto/jwt"
+	"github.com/ooqls/go-log"
+	"github.com/ooqls/go-log/api/v1/gen"
+	"go.uber.org/zap"
+)
+
+const defaultConfigWatchInterval = 2 * time.Second
+
+// reloadableConfigKeys are the config keys that are applied without a
+// restart, a key ending with a dot covers every key below it.
+var reloadableConfigKeys = []string{
+	"gin.cors.",
+	"jwt.token_configuration_paths",
+	"jwt.token_configurations",
+	"health.interval",
+	"log.level",
+}
+
+func reloadable(key string) bool {
+	for _, k := range reloadableConfigKeys {
+		if key == k || (strings.HasSuffix(k, ".") && strings.HasPrefix(key, k)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ConfigReload is the result of a config reload.
+type ConfigReload struct {
+	// Applied holds the changed keys that were applied at runtime.
+	Applied []string
+	// RestartRequired holds the changed keys that only apply after a restart.
+	RestartRequired []string
+}
+
+// diffConfig returns the keys of the values that differ between old and new.
+func diffConfig(old, new *AppConfig) []string {
+	oldValues := map[string]reflect.Value{}
+	for _, f := range configFields(old) {
+		oldValues[f.key] = f.value
+	}
+
+	changed := []string{}
+	for _, f := range configFields(new) {
+		if !reflect.DeepEqual(oldValues[f.key].Interface(), f.value.Interface()) {
+			changed = append(changed, f.key)
+		}
+	}
+
+	return changed
+}
+
+// setLogLevel sets the level of the app loggers, empty keeps the level.
+func setLogLevel(level string) error {
+	lvl, err := parseLogLevel(level)
+	if err == nil && lvl != "" {
+		log.SetLogLevel(lvl)
+	}
+
+	return err
+}
+
+// parseLogLevel returns the level of level, empty for an empty level.
+func parseLogLevel(level string) (gen.LevelEnum, error) {
+	if level == "" {
+		return "", nil
+	}
+
+	lvl := gen.LevelEnum(strings.ToUpper(level))
+	switch lvl {
+	case gen.DEBUG, gen.INFO, gen.WARNING, gen.ERROR:
+		return lvl, nil
+	default:
+		return "", fmt.Errorf("unknown log level %s", level)
+	}
+}
+
+func (a *app) _startup_config(ctx *AppContext) error {
+	if a.config == nil {
+		ec, err := a.configLoader.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load config: %v", err)
+		}
+		a.config = ec.Config
+	}
+
+	return setLogLevel(a.config.Log.Level)
+}
+
+// _run_config watches the config files and the token configuration files
+// they reference, and reloads the config when they change.
+func (a *app) _run_config(ctx *AppContext) error {
+	files := a._config_files()
+	if len(files) == 0 {
+		return nil
+	}
+
+	a.l.Info("[Running Config] watching config files", zap.Strings("files", files))
+	watchCtx, cancel := context.WithCancel(context.Background())
+	done := watchFiles(watchCtx, a._config_files, a.configWatchInterval, func() {
+		a.l.Info("[Config] config files changed, reloading")
+		_, _ = a.ReloadConfig()
+	})
+	a.stopConfigWatch = func() {
+		cancel()
+		<-done
+	}
+
+	return nil
+}
+
+// _config_files returns the config files and the token configuration files
+// of the current config.
+func (a *app) _config_files() []string {
+	files := a.configLoader.Files()
+	a.configM.Lock()
+	defer a.configM.Unlock()
+
+	return append(files, a.config.JWT.TokenConfigurationPaths...)
+}
+
+func (a *app) _stop_config(ctx context.Context) error {
+	if a.stopConfigWatch != nil {
+		a.stopConfigWatch()
+		a.stopConfigWatch = nil
+	}
+
+	return nil
+}
+
+func (a *app) _reload_config(ctx *AppContext) error {
+	_, err := a.ReloadConfig()
+	return err
+}
+
+// ReloadConfig loads and validates the config again and applies the changes
+// that are safe at runtime: cors, token configurations, the health interval
+// and the log level. The other changes are reported as requiring a restart.
+// It is called when the config files change and on SIGHUP.
+func (a *app) ReloadConfig() (*ConfigReload, error) {
+	l := a.l
+	if a.configLoader == nil {
+		return nil, fmt.Errorf("config reload is not enabled")
+	}
+
+	a.configM.Lock()
+	defer a.configM.Unlock()
+
+	ec, err := a.configLoader.Load()
+	if err != nil {
+		l.Error("[Config] failed to load config, keeping the current one", zap.Error(err))
+		return nil, err
+	}
+
+	cfg := ec.Config
+	if err := cfg.Validate(); err != nil {
+		l.Error("[Config] invalid config, keeping the current one", zap.Error(err))
+		return nil, err
+	}
+
+	reload := &ConfigReload{}
+	for _, key := range diffConfig(a.config, cfg) {
+		if reloadable(key) {
+			reload.Applied = append(reload.Applied, key)
+		} else {
+			reload.RestartRequired = append(reload.RestartRequired, key)
+		}
+	}
+
+	if err := a._apply_config(cfg, reload); err != nil {
+		l.Error("[Config] failed to apply config", zap.Error(err))
+		return nil, err
+	}
+	a.config = cfg
+
+	l.Info("[Config] config reloaded", zap.Strings("applied", reload.Applied))
+	if len(reload.RestartRequired) > 0 {
+		l.Warn("[Config] changed config requires a restart", zap.Strings("keys", reload.RestartRequired))
+	}
+
+	return reload, nil
+}
+
+// _apply_config applies the changes of reload to the running app. Every
+// change is prepared first, so nothing is applied when one of them fails.
+// Token configurations that changed in their files are applied and reported
+// as well.
+func (a *app) _apply_config(cfg *AppConfig, reload *ConfigReload) error {
+	changed := map[string]bool{}
+	for _, key := range reload.Applied {
+		if strings.HasPrefix(key, "gin.cors.") {
+			key = "gin.cors."
+		}
+		changed[key] = true
+	}
+
+	errs := []error{}
+	setCors := changed["gin.cors."] && a.features.Gin.Enabled
+	var cors *gin.HandlerFunc
+	if setCors {
+		h, err := corsHandler(cfg.Gin.Cors.CorsConfig())
+		cors = h
+		errs = append(errs, err)
+	}
+
+	appCtx := a._app_ctx()
+	tokensChanged := changed["jwt.token_configuration_paths"] || changed["jwt.token_configurations"]
+	var tokenConfigs map[string]jwt.TokenConfiguration
+	if appCtx != nil && (tokensChanged || len(cfg.JWT.TokenConfigurationPaths) > 0) {
+		configs, err := loadTokenConfigs(cfg.JWT.TokenConfigurationPaths, cfg.JWT.TokenConfigurations)
+		if err == nil && (tokensChanged || !reflect.DeepEqual(configs, appCtx.tokenConfigs())) {
+			tokenConfigs = configs
+		}
+		errs = append(errs, err)
+	}
+
+	var level gen.LevelEnum
+	if changed["log.level"] {
+		lvl, err := parseLogLevel(cfg.Log.Level)
+		level = lvl
+		errs = append(errs, err)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	if setCors {
+		a.cors.Store(cors)
+	}
+
+	if tokenConfigs != nil {
+		appCtx.setTokenConfigs(tokenConfigs)
+		if !tokensChanged {
+			reload.Applied = append(reload.Applied, "jwt.token_configuration_paths")
+		}
+	}
+
+	if changed["health.interval"] {
+		select {
+		case <-a.healthInterval:
+		default:
+		}
+		a.healthInterval <- healthInterval(cfg.Health.Interval)
+	}
+
+	if level != "" {
+		log.SetLogLevel(level)
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RedactedValue replaces the values resolved from secret references when a config
+// is logged or dumped.
+const RedactedValue = "[REDACTED]"
+
+// secretRef matches references like ${env:DB_PASSWORD} or ${file:/run/secrets/db}.
+var secretRef = regexp.MustCompile(`\$\{([a-zA-Z][a-zA-Z0-9_-]*):([^}]*)\}`)
+
+// SecretResolver resolves the secret references of one scheme, e.g. env for
+// ${env:DB_PASSWORD}. Resolve is called with the part after the scheme.
+type SecretResolver interface {
+	Resolve(ref string) (string, error)
+}
+
+// SecretResolverFunc adapts a function to SecretResolver.
+type SecretResolverFunc func(ref string) (string, error)
+
+func (f SecretResolverFunc) Resolve(ref string) (string, error) {
+	return f(ref)
+}
+
+// EnvSecretResolver resolves ${env:NAME} from the environment.
+var EnvSecretResolver SecretResolver = SecretResolverFunc(func(name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	return v, nil
+})
+
+// FileSecretResolver resolves ${file:/path} to the content of the file
+// without its trailing newline.
+var FileSecretResolver SecretResolver = SecretResolverFunc(func(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+})
+
+// defaultSecretResolvers returns the resolvers of the env and file schemes.
+func defaultSecretResolvers() map[string]SecretResolver {
+	return map[string]SecretResolver{
+		"env":  EnvSecretResolver,
+		"file": FileSecretResolver,
+	}
+}
+
+// resolveSecret replaces the secret references in s, it reports whether s had any.
+func resolveSecret(resolvers map[string]SecretResolver, s string) (string, bool, error) {
+	if !secretRef.MatchString(s) {
+		return s, false, nil
+	}
+
+	var err error
+	resolved := secretRef.ReplaceAllStringFunc(s, func(ref string) string {
+		m := secretRef.FindStringSubmatch(ref)
+		r, ok := resolvers[m[1]]
+		if !ok {
+			err = fmt.Errorf("no secret resolver for %s", m[1])
+			return ref
+		}
+
+		v, resolveErr := r.Resolve(m[2])
+		if resolveErr != nil {
+			err = fmt.Errorf("failed to resolve %s: %v", ref, resolveErr)
+			return ref
+		}
+
+		return v
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	return resolved, true, nil
+}
+
+// walkStrings calls fn with every string in v, in nested structs, slices and
+// maps as well. Map keys are passed too, they can not be set.
+func walkStrings(v reflect.Value, fn func(s reflect.Value)) {
+	switch v.Kind() {
+	case reflect.String:
+		fn(v)
+	case reflect.Pointer:
+		if !v.IsNil() {
+			walkStrings(v.Elem(), fn)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			walkStrings(v.Index(i), fn)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				walkStrings(v.Field(i), fn)
+			}
+		}
+	case reflect.Map:
+		for _, k := range v.MapKeys() {
+			walkStrings(k, fn)
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(v.MapIndex(k))
+			walkStrings(value, fn)
+			v.SetMapIndex(k, value)
+		}
+	}
+}
+
+// resolveSecrets replaces the secret references in the string values of c,
+// including the ones in lists of structs and maps, the keys of the resolved
+// values are redacted. References in map keys are rejected.
+func (c *AppConfig) resolveSecrets(resolvers map[string]SecretResolver) error {
+	problems := []string{}
+	c.secrets = map[string]bool{}
+	for _, f := range configFields(c) {
+		walkStrings(f.value, func(s reflect.Value) {
+			v, secret, err := resolveSecret(resolvers, s.String())
+			switch {
+			case err != nil:
+				problems = append(problems, fmt.Sprintf("%s: %v", f.key, err))
+			case secret && !s.CanSet():
+				problems = append(problems, fmt.Sprintf("%s: secret references in keys are not resolved", f.key))
+			case secret:
+				s.SetString(v)
+				c.secrets[f.key] = true
+			}
+		})
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("failed to resolve secrets: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// IsSecret reports whether the value of key was resolved from a secret reference.
+func (c *AppConfig) IsSecret(key string) bool {
+	return c.secrets[key]
+}
+
+// Redacted returns a copy of the config with the values that were resolved
+// from secret references replaced by RedactedValue.
+func (c *AppConfig) Redacted() *AppConfig {
+	redacted := c.clone()
+	for _, f := range configFields(redacted) {
+		if !c.secrets[f.key] {
+			continue
+		}
+
+		walkStrings(f.value, func(s reflect.Value) {
+			if s.CanSet() {
+				s.SetString(RedactedValue)
+			}
+		})
+	}
+
+	return redacted
+}
+
+// String returns the config as yaml with the secrets redacted, so logging a
+// config does not leak them.
+func (c *AppConfig) String() string {
+	b, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return fmt.Sprintf("invalid config: %v", err)
+	}
+
+	return string(b)
+}
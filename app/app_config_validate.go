@@ -0,0 +1,372 @@
+package app
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ConfigProblem is a single problem of a config found by Validate.
+type ConfigProblem struct {
+	// Key is the dotted key of the value, e.g. gin.port.
+	Key string
+	// Position is where the value was set, e.g. app_config.yaml:12 or
+	// env:APP_GIN_PORT, empty for defaults.
+	Position string
+	Message  string
+}
+
+func (p ConfigProblem) String() string {
+	if p.Position == "" {
+		return fmt.Sprintf("%s: %s", p.Key, p.Message)
+	}
+
+	return fmt.Sprintf("%s: %s: %s", p.Position, p.Key, p.Message)
+}
+
+// ConfigValidationError is returned by Validate with every problem of the config.
+type ConfigValidationError struct {
+	Problems []ConfigProblem
+}
+
+func (e *ConfigValidationError) Error() string {
+	lines := []string{fmt.Sprintf("invalid config, %d problem(s):", len(e.Problems))}
+	for _, p := range e.Problems {
+		lines = append(lines, "  "+p.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// configValidator collects the problems of a config.
+type configValidator struct {
+	cfg      *AppConfig
+	problems []ConfigProblem
+}
+
+func (v *configValidator) problem(key, format string, args ...interface{}) {
+	v.problems = append(v.problems, ConfigProblem{
+		Key:      key,
+		Position: v.cfg.positions[key],
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// file reports a problem when path is set but is not an existing file.
+func (v *configValidator) file(key, path string) {
+	if path == "" {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if v.cfg.secrets[key] {
+		path = RedactedValue
+	}
+	if err != nil {
+		v.problem(key, "file %s does not exist", path)
+		return
+	}
+	if info.IsDir() {
+		v.problem(key, "%s is a directory, expected a file", path)
+	}
+}
+
+// dir reports a problem when path is set but is not an existing directory.
+func (v *configValidator) dir(key, path string) {
+	if path == "" {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if v.cfg.secrets[key] {
+		path = RedactedValue
+	}
+	if err != nil {
+		v.problem(key, "directory %s does not exist", path)
+		return
+	}
+	if !info.IsDir() {
+		v.problem(key, "%s is not a directory", path)
+	}
+}
+
+func (v *configValidator) ports() {
+	type server struct {
+		key      string
+		enabled  bool
+		port     int
+		required bool
+	}
+	c := v.cfg
+	servers := []server{
+		{key: "gin.port", enabled: c.Gin.Enabled, port: c.Gin.Port, required: true},
+		{key: "http.port", enabled: c.HTTP.Enabled, port: c.HTTP.Port, required: true},
+		{key: "logging_api.port", enabled: c.LoggingAPI.Enabled, port: c.LoggingAPI.Port, required: true},
+		{key: "metrics.port", enabled: c.Metrics.Enabled, port: c.Metrics.Port},
+		{key: "tls.acme.http_port", enabled: c.TLS.Enabled && c.TLS.ACME.Enabled, port: c.TLS.ACME.HTTPPort},
+	}
+
+	used := map[int]string{}
+	for _, s := range servers {
+		if !s.enabled {
+			continue
+		}
+
+		if s.port == 0 {
+			if s.required {
+				v.problem(s.key, "a port is required when the server is enabled")
+			}
+			continue
+		}
+
+		if s.port < 1 || s.port > 65535 {
+			v.problem(s.key, "port %d is out of range 1-65535", s.port)
+			continue
+		}
+
+		if other, ok := used[s.port]; ok {
+			v.problem(s.key, "port %d is already used by %s", s.port, other)
+			continue
+		}
+		used[s.port] = s.key
+	}
+}
+
+func (v *configValidator) files() {
+	c := v.cfg
+	if c.TLS.Enabled {
+		if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+			v.problem("tls.cert_file", "cert_file and key_file have to be set together")
+		}
+		v.file("tls.cert_file", c.TLS.CertFile)
+		v.file("tls.key_file", c.TLS.KeyFile)
+		v.file("tls.ca_path", c.TLS.CaPath)
+	}
+
+	if c.JWT.Enabled {
+		if (c.JWT.RSAKeyPath == "") != (c.JWT.RSAPubKeyPath == "") {
+			v.problem("jwt.rsa_key_path", "rsa_key_path and rsa_pub_key_path have to be set together")
+		}
+		v.file("jwt.rsa_key_path", c.JWT.RSAKeyPath)
+		v.file("jwt.rsa_pub_key_path", c.JWT.RSAPubKeyPath)
+		if c.JWT.KeyDir != "" && (c.JWT.RSAKeyPath != "" || c.JWT.RSAPubKeyPath != "") {
+			v.problem("jwt.key_dir", "key_dir can not be used together with rsa_key_path and rsa_pub_key_path")
+		}
+		v.dir("jwt.key_dir", c.JWT.KeyDir)
+		for _, path := range c.JWT.PreviousKeyPaths {
+			v.file("jwt.previous_key_paths", path)
+		}
+		for _, path := range c.JWT.TokenConfigurationPaths {
+			v.file("jwt.token_configuration_paths", path)
+		}
+	}
+
+	if c.RSA.Enabled {
+		if (c.RSA.PrivateKeyPath == "") != (c.RSA.PublicKeyPath == "") {
+			v.problem("rsa.private_key_path", "private_key_path and public_key_path have to be set together")
+		}
+		v.file("rsa.private_key_path", c.RSA.PrivateKeyPath)
+		v.file("rsa.public_key_path", c.RSA.PublicKeyPath)
+	}
+
+	if c.Registry.Enabled {
+		v.file("registry.path", c.Registry.Path)
+	}
+}
+
+func (v *configValidator) sql() {
+	c := v.cfg.SQLFiles
+	switch c.SQLPackage {
+	case PGXPackage, SQLXPackage:
+	case "":
+		if c.Enabled {
+			v.problem("sql.sql_package", "sql_package is required, expected %s or %s", PGXPackage, SQLXPackage)
+		}
+	default:
+		v.problem("sql.sql_package", "unknown sql_package %q, expected %s or %s", c.SQLPackage, PGXPackage, SQLXPackage)
+	}
+
+	if c.Enabled {
+		for _, dir := range c.SQLFilesDirs {
+			v.dir("sql.sql_files_dirs", dir)
+		}
+	}
+}
+
+func (v *configValidator) cors() {
+	c := v.cfg.Gin.Cors
+	if !c.Enabled {
+		return
+	}
+
+	if !v.cfg.Gin.Enabled {
+		v.problem("gin.cors.enabled", "cors is enabled but gin is not")
+	}
+
+	if c.AllowAllOrigins && len(c.AllowOrigins) > 0 {
+		v.problem("gin.cors.origins", "origins can not be set together with allow_all_origins")
+	}
+
+	if !c.AllowAllOrigins && len(c.AllowOrigins) == 0 {
+		v.problem("gin.cors.origins", "origins are required unless allow_all_origins is set")
+	}
+
+	for _, origin := range c.AllowOrigins {
+		if origin == "*" {
+			v.problem("gin.cors.origins", "use allow_all_origins instead of the origin *")
+			continue
+		}
+		if strings.Contains(origin, "*") && !c.AllowWildcard {
+			v.problem("gin.cors.origins", "origin %s has a wildcard but allow_wildcard is not set", origin)
+		}
+	}
+
+	if c.AllowCredentials && c.AllowAllOrigins {
+		v.problem("gin.cors.allow_credentials", "allow_credentials can not be used with allow_all_origins")
+	}
+
+	if c.MaxAge < 0 {
+		v.problem("gin.cors.max_age", "max_age can not be negative")
+	}
+}
+
+func (v *configValidator) clientAuth() {
+	c := v.cfg.TLS
+	if !c.Enabled {
+		return
+	}
+
+	servers := map[string]bool{
+		GinFeatureName:        true,
+		HTTPFeatureName:       true,
+		LoggingAPIFeatureName: true,
+		MetricsFeatureName:    true,
+	}
+	check := func(key string, mode ClientAuthMode) {
+		if _, err := mode.tlsClientAuth(); err != nil {
+			v.problem(key, "%v", err)
+			return
+		}
+		if mode == ClientAuthVerify && c.CaPath == "" {
+			v.problem(key, "client auth verify needs ca_path to verify client certificates with")
+		}
+	}
+
+	check("tls.client_auth", ClientAuthMode(c.ClientAuth))
+	for server, mode := range c.ServerClientAuth {
+		if !servers[server] {
+			v.problem("tls.server_client_auth", "unknown server %s, expected gin, http, logging-api or metrics", server)
+			continue
+		}
+		check("tls.server_client_auth", ClientAuthMode(mode))
+	}
+}
+
+func (v *configValidator) acme() {
+	c := v.cfg.TLS
+	if !c.Enabled || !c.ACME.Enabled {
+		return
+	}
+
+	if len(c.ACME.Domains) == 0 {
+		v.problem("tls.acme.domains", "at least one domain is required")
+	}
+
+	for _, domain := range c.ACME.Domains {
+		if !strings.Contains(strings.Trim(domain, "."), ".") {
+			v.problem("tls.acme.domains", "domain %s is not a fully qualified domain name", domain)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		v.problem("tls.cert_file", "cert_file and key_file can not be used together with acme")
+	}
+}
+
+func (v *configValidator) jwks() {
+	c := v.cfg.JWT
+	if !c.Enabled {
+		return
+	}
+
+	if c.JWKSPath != "" && !strings.HasPrefix(c.JWKSPath, "/") {
+		v.problem("jwt.jwks_path", "path %s has to start with /", c.JWKSPath)
+	}
+
+	for _, r := range c.RemoteJWKS {
+		u, err := url.Parse(r.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.problem("jwt.remote_jwks", "%s is not an http or https url", r.URL)
+		}
+		if len(r.Issuers) == 0 {
+			v.problem("jwt.remote_jwks", "jwks %s needs the issuers its keys verify tokens of", r.URL)
+		}
+	}
+
+	if c.JWKSRefreshInterval < 0 {
+		v.problem("jwt.jwks_refresh_interval", "jwks_refresh_interval can not be negative")
+	}
+
+	if c.RotationInterval < 0 {
+		v.problem("jwt.rotation_interval", "rotation_interval can not be negative")
+	}
+
+	if c.maxPreviousKeys() < 0 {
+		v.problem("jwt.max_previous_keys", "max_previous_keys can not be negative")
+	}
+}
+
+func (v *configValidator) auth() {
+	c := v.cfg
+	if !c.Auth.Enabled {
+		return
+	}
+
+	if !c.JWT.Enabled {
+		v.problem("auth.enabled", "auth is enabled but jwt is not")
+	}
+
+	if !c.Gin.Enabled && !c.HTTP.Enabled {
+		v.problem("auth.enabled", "auth needs gin or http to serve its routes")
+	}
+
+	if c.Auth.Path != "" && !strings.HasPrefix(c.Auth.Path, "/") {
+		v.problem("auth.path", "path %s has to start with /", c.Auth.Path)
+	}
+}
+
+func (v *configValidator) log() {
+	level := v.cfg.Log.Level
+	if level == "" {
+		return
+	}
+
+	switch strings.ToUpper(level) {
+	case "DEBUG", "INFO", "WARNING", "ERROR":
+	default:
+		v.problem("log.level", "unknown level %q, expected DEBUG, INFO, WARNING or ERROR", level)
+	}
+}
+
+// Validate checks the config before the app is started. It returns a
+// *ConfigValidationError with every problem found, positioned at the line of
+// the config file or the source that set the value.
+func (c *AppConfig) Validate() error {
+	v := &configValidator{cfg: c}
+	v.ports()
+	v.files()
+	v.sql()
+	v.cors()
+	v.clientAuth()
+	v.acme()
+	v.jwks()
+	v.auth()
+	v.log()
+
+	if len(v.problems) == 0 {
+		return nil
+	}
+
+	return &ConfigValidationError{Problems: v.problems}
+}
@@ -1,11 +1,57 @@
 package app
 
 import (
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// Names of the built-in features. They can be used as dependencies by
+// features added with Register.
+const (
+	RegistryFeatureName   = "registry"
+	JWTFeatureName        = "jwt"
+	RSAFeatureName        = "rsa"
+	SQLFeatureName        = "sql"
+	DocsFeatureName       = "docs"
+	LoggingAPIFeatureName = "logging-api"
+	TLSFeatureName        = "tls"
+	HealthFeatureName     = "health"
+	GinFeatureName        = "gin"
+	HTTPFeatureName       = "http"
+	MetricsFeatureName    = "metrics"
+	TracingFeatureName    = "tracing"
+	AccessLogFeatureName  = "access-log"
+	RequestIDFeatureName  = "request-id"
+	RecoveryFeatureName   = "recovery"
+	ConfigFeatureName     = "config"
+	AuthFeatureName       = "auth"
+)
+
+// Feature is a subsystem that takes part in the app lifecycle. The built-in
+// features and the ones added with Register are started and stopped the same way.
+type Feature interface {
+	// Name identifies the feature, it has to be unique within an app.
+	Name() string
+	// Dependencies returns the names of the features this feature needs.
+	Dependencies() []string
+	// Start is called once on startup before the app is running.
+	Start(ctx *AppContext) error
+	// Stop is called once when the app is stopping.
+	Stop(ctx context.Context) error
+	// Health returns an error when the feature is not healthy.
+	Health(ctx context.Context) error
+}
+
+// Reloader can be implemented by a feature that is able to reload its
+// configuration without a restart. Reload is called when the app receives SIGHUP.
+type Reloader interface {
+	Reload(ctx *AppContext) error
+}
+
 type featureOpt struct {
 	key   string
 	value interface{}
@@ -35,10 +81,24 @@ func WithConfig(cfg *AppConfig) Features {
 			DocsPort:    cfg.DocsConfig.DocsPort,
 		},
 		TLS: TLSFeature{
-			Enabled:        cfg.TLS.Enabled,
-			ServerCertFile: cfg.TLS.CertFile,
-			ServerKeyFile:  cfg.TLS.KeyFile,
-			CAFile:         cfg.TLS.CaPath,
+			Enabled:          cfg.TLS.Enabled,
+			ServerCertFile:   cfg.TLS.CertFile,
+			ServerKeyFile:    cfg.TLS.KeyFile,
+			CAFile:           cfg.TLS.CaPath,
+			ReloadInterval:   time.Duration(cfg.TLS.ReloadInterval) * time.Second,
+			ClientAuth:       ClientAuthMode(cfg.TLS.ClientAuth),
+			ServerClientAuth: cfg.TLS.serverClientAuth(),
+			DevCerts:         cfg.TLS.DevCerts.Enabled,
+			DevCertHosts:     cfg.TLS.DevCerts.Hosts,
+			DevCertDir:       cfg.TLS.DevCerts.Dir,
+			ACME: ACMESettings{
+				Enabled:      cfg.TLS.ACME.Enabled,
+				Domains:      cfg.TLS.ACME.Domains,
+				Email:        cfg.TLS.ACME.Email,
+				CacheDir:     cfg.TLS.ACME.CacheDir,
+				DirectoryURL: cfg.TLS.ACME.DirectoryURL,
+				HTTPPort:     cfg.TLS.ACME.HTTPPort,
+			},
 		},
 		RSA: RSAFeature{
 			Enabled:        cfg.RSA.Enabled,
@@ -51,11 +111,21 @@ func WithConfig(cfg *AppConfig) Features {
 			PrivateKeyPath:          cfg.JWT.RSAKeyPath,
 			PubKeyPath:              cfg.JWT.RSAPubKeyPath,
 			tokenConfiguration:      cfg.JWT.TokenConfigurations,
+			JWKSPath:                orDefault(cfg.JWT.JWKSPath, DefaultJWKSPath),
+			RemoteJWKS:              cfg.JWT.RemoteJWKS,
+			JWKSRefreshInterval:     time.Duration(cfg.JWT.JWKSRefreshInterval) * time.Second,
+			KeyDir:                  cfg.JWT.KeyDir,
+			PreviousKeyPaths:        cfg.JWT.PreviousKeyPaths,
+			RotationInterval:        time.Duration(cfg.JWT.RotationInterval) * time.Second,
+			MaxPreviousKeys:         maxPreviousJWTKeys(cfg.JWT.maxPreviousKeys()),
 		},
 		Health: HealthFeature{
-			Enabled:  cfg.Health.Enabled,
-			Path:     cfg.Health.Path,
-			Interval: cfg.Health.Interval,
+			Enabled:       cfg.Health.Enabled,
+			Path:          cfg.Health.Path,
+			Interval:      cfg.Health.Interval,
+			LivenessPath:  orDefault(cfg.Health.LivenessPath, DefaultLivenessPath),
+			ReadinessPath: orDefault(cfg.Health.ReadinessPath, DefaultReadinessPath),
+			StartupPath:   orDefault(cfg.Health.StartupPath, DefaultStartupPath),
 		},
 		SQL: SQLFeature{
 			Enabled:               cfg.SQLFiles.Enabled,
@@ -69,9 +139,43 @@ func WithConfig(cfg *AppConfig) Features {
 			enabled:      cfg.Registry.Enabled,
 			registryPath: &cfg.Registry.Path,
 		},
+		Metrics: MetricsFeature{
+			Enabled:  cfg.Metrics.Enabled,
+			Port:     cfg.Metrics.Port,
+			Path:     orDefault(cfg.Metrics.Path, DefaultMetricsPath),
+			Registry: prometheus.NewRegistry(),
+		},
+		Tracing: TracingFeature{
+			Enabled:     cfg.Tracing.Enabled,
+			Exporter:    orDefault(cfg.Tracing.Exporter, TracingExporterOTLP),
+			Endpoint:    cfg.Tracing.Endpoint,
+			Insecure:    cfg.Tracing.Insecure,
+			File:        cfg.Tracing.File,
+			SampleRatio: cfg.Tracing.sampleRatio(),
+			ServiceName: cfg.Tracing.ServiceName,
+		},
+		AccessLog: AccessLogFeature{
+			Enabled:       cfg.AccessLog.Enabled,
+			SampleRate:    cfg.AccessLog.sampleRate(),
+			ExcludePaths:  cfg.AccessLog.ExcludePaths,
+			ExcludeHealth: cfg.AccessLog.excludeHealth(),
+		},
+		Auth: AuthFeature{
+			Enabled: cfg.Auth.Enabled,
+			Path:    orDefault(cfg.Auth.Path, DefaultAuthPath),
+			Store:   NewMemoryRefreshTokenStore(),
+		},
 	}
 }
 
+func orDefault(v, def string) string {
+	if v == "" {
+		return def
+	}
+
+	return v
+}
+
 type Features struct {
 	LoggingAPI LoggingApiFeature
 	RSA        RSAFeature
@@ -83,4 +187,8 @@ type Features struct {
 	Docs       DocsFeature
 	Health     HealthFeature
 	Gin        GinFeature
+	Metrics    MetricsFeature
+	Tracing    TracingFeature
+	AccessLog  AccessLogFeature
+	Auth       AuthFeature
 }
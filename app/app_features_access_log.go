@@ -0,0 +1,60 @@
+package app
+
+const (
+	accessLog_sampleRateOpt    string = "opt-access-log-sample-rate"
+	accessLog_excludePathsOpt  string = "opt-access-log-exclude-paths"
+	accessLog_excludeHealthOpt string = "opt-access-log-exclude-health"
+)
+
+type accessLogOpt struct {
+	featureOpt
+}
+
+// WithAccessLogSampleRate logs the given fraction of the requests. Requests
+// that fail with a server error are always logged.
+func WithAccessLogSampleRate(rate float64) accessLogOpt {
+	return accessLogOpt{featureOpt: featureOpt{key: accessLog_sampleRateOpt, value: rate}}
+}
+
+// WithAccessLogExcludePaths does not log the requests to the given paths.
+func WithAccessLogExcludePaths(paths ...string) accessLogOpt {
+	return accessLogOpt{featureOpt: featureOpt{key: accessLog_excludePathsOpt, value: paths}}
+}
+
+// WithAccessLogExcludeHealth sets whether the requests to the health
+// endpoints are logged, they are excluded by default.
+func WithAccessLogExcludeHealth(exclude bool) accessLogOpt {
+	return accessLogOpt{featureOpt: featureOpt{key: accessLog_excludeHealthOpt, value: exclude}}
+}
+
+type AccessLogFeature struct {
+	Enabled       bool
+	SampleRate    float64
+	ExcludePaths  []string
+	ExcludeHealth bool
+}
+
+func (f *AccessLogFeature) apply(opt accessLogOpt) {
+	switch opt.key {
+	case accessLog_sampleRateOpt:
+		f.SampleRate = opt.value.(float64)
+	case accessLog_excludePathsOpt:
+		f.ExcludePaths = append(f.ExcludePaths, opt.value.([]string)...)
+	case accessLog_excludeHealthOpt:
+		f.ExcludeHealth = opt.value.(bool)
+	}
+}
+
+func AccessLog(opts ...accessLogOpt) AccessLogFeature {
+	f := AccessLogFeature{
+		Enabled:       true,
+		SampleRate:    1,
+		ExcludeHealth: true,
+	}
+
+	for _, opt := range opts {
+		f.apply(opt)
+	}
+
+	return f
+}
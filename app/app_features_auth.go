@@ -0,0 +1,92 @@
+package app
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	auth_pathOpt      string = "opt-auth-path"
+	auth_validatorOpt string = "opt-auth-validator"
+	auth_storeOpt     string = "opt-auth-store"
+)
+
+const DefaultAuthPath = "/token"
+
+// ErrInvalidCredentials is returned by a CredentialValidator for wrong
+// credentials, the login is answered with 401.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Credentials are the credentials of a login.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// CredentialValidator checks the credentials of a login and returns the
+// subject the tokens are issued for.
+type CredentialValidator interface {
+	ValidateCredentials(ctx context.Context, c Credentials) (subject string, err error)
+}
+
+// CredentialValidatorFunc adapts a function to CredentialValidator.
+type CredentialValidatorFunc func(ctx context.Context, c Credentials) (string, error)
+
+func (f CredentialValidatorFunc) ValidateCredentials(ctx context.Context, c Credentials) (string, error) {
+	return f(ctx, c)
+}
+
+type authOpt struct {
+	featureOpt
+}
+
+// WithAuthPath sets the path the token routes are mounted under, /token by default.
+func WithAuthPath(path string) authOpt {
+	return authOpt{featureOpt: featureOpt{key: auth_pathOpt, value: path}}
+}
+
+// WithCredentialValidator enables the login route, a POST of the credentials
+// to the auth path.
+func WithCredentialValidator(v CredentialValidator) authOpt {
+	return authOpt{featureOpt: featureOpt{key: auth_validatorOpt, value: v}}
+}
+
+// WithRefreshTokenStore sets where the issued refresh tokens are tracked, by
+// default they are kept in memory and do not survive a restart.
+func WithRefreshTokenStore(s RefreshTokenStore) authOpt {
+	return authOpt{featureOpt: featureOpt{key: auth_storeOpt, value: s}}
+}
+
+// AuthFeature issues access tokens of the auth issuer and refresh tokens of
+// the refresh issuer. It needs the JWT feature and the gin engine or the http mux.
+type AuthFeature struct {
+	Enabled   bool
+	Path      string
+	Validator CredentialValidator
+	Store     RefreshTokenStore
+}
+
+func (f *AuthFeature) apply(opt authOpt) {
+	switch opt.key {
+	case auth_pathOpt:
+		f.Path = opt.value.(string)
+	case auth_validatorOpt:
+		f.Validator = opt.value.(CredentialValidator)
+	case auth_storeOpt:
+		f.Store = opt.value.(RefreshTokenStore)
+	}
+}
+
+func Auth(opts ...authOpt) AuthFeature {
+	f := AuthFeature{
+		Enabled: true,
+		Path:    DefaultAuthPath,
+		Store:   NewMemoryRefreshTokenStore(),
+	}
+
+	for _, opt := range opts {
+		f.apply(opt)
+	}
+
+	return f
+}
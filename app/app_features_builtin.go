@@ -0,0 +1,278 @@
+package app
+
+import (
+	"context"
+	"fmt"
+)
+
+// builtinFeature adapts the internal startup functions to the Feature interface.
+// run is called once all features are started and the app is about to run.
+type builtinFeature struct {
+	name   string
+	deps   []string
+	start  func(ctx *AppContext) error
+	run    func(ctx *AppContext) error
+	stop   func(ctx context.Context) error
+	reload func(ctx *AppContext) error
+	health func(ctx context.Context) error
+}
+
+func (f *builtinFeature) Name() string {
+	return f.name
+}
+
+func (f *builtinFeature) Dependencies() []string {
+	return f.deps
+}
+
+func (f *builtinFeature) Start(ctx *AppContext) error {
+	return f.start(ctx)
+}
+
+func (f *builtinFeature) Stop(ctx context.Context) error {
+	if f.stop == nil {
+		return nil
+	}
+
+	return f.stop(ctx)
+}
+
+func (f *builtinFeature) Reload(ctx *AppContext) error {
+	if f.reload == nil {
+		return nil
+	}
+
+	return f.reload(ctx)
+}
+
+func (f *builtinFeature) Health(ctx context.Context) error {
+	if f.health == nil {
+		return nil
+	}
+
+	return f.health(ctx)
+}
+
+func noop(ctx *AppContext) error {
+	return nil
+}
+
+// _enabled_names returns the names of the built-in features in names that are enabled.
+func (a *app) _enabled_names(names ...string) []string {
+	enabled := map[string]bool{
+		ConfigFeatureName:     a.configLoader != nil,
+		RegistryFeatureName:   a.features.Registry.enabled,
+		JWTFeatureName:        a.features.JWT.Enabled,
+		RSAFeatureName:        a.features.RSA.Enabled,
+		SQLFeatureName:        a.features.SQL.Enabled,
+		DocsFeatureName:       a.features.Docs.Enabled,
+		LoggingAPIFeatureName: a.features.LoggingAPI.Enabled,
+		TLSFeatureName:        a.features.TLS.Enabled,
+		HealthFeatureName:     a.features.Health.Enabled,
+		GinFeatureName:        a.features.Gin.Enabled,
+		HTTPFeatureName:       a.features.HTTP.Enabled,
+		MetricsFeatureName:    a.features.Metrics.Enabled,
+		TracingFeatureName:    a.features.Tracing.Enabled,
+		AccessLogFeatureName:  a.features.AccessLog.Enabled,
+		RequestIDFeatureName:  a.features.Gin.Enabled || a.features.HTTP.Enabled,
+		RecoveryFeatureName:   a.features.Gin.Enabled || a.features.HTTP.Enabled,
+		AuthFeatureName:       a.features.Auth.Enabled,
+	}
+
+	deps := []string{}
+	for _, name := range names {
+		if enabled[name] {
+			deps = append(deps, name)
+		}
+	}
+
+	return deps
+}
+
+func (a *app) _builtin_features() []Feature {
+	l := a.l
+	features := []Feature{}
+
+	if a.configLoader != nil {
+		l.Info("[Startup] Config reload enabled")
+		features = append(features, &builtinFeature{
+			name:   ConfigFeatureName,
+			start:  a._startup_config,
+			run:    a._run_config,
+			stop:   a._stop_config,
+			reload: a._reload_config,
+		})
+	}
+
+	if a.features.Tracing.Enabled {
+		l.Info("[Startup] Tracing enabled")
+		features = append(features, &builtinFeature{
+			name:  TracingFeatureName,
+			start: a._startup_tracing,
+			stop:  a._stop_tracing,
+		})
+	}
+
+	if a.features.Gin.Enabled || a.features.HTTP.Enabled {
+		features = append(features, &builtinFeature{
+			name:  RequestIDFeatureName,
+			deps:  a._enabled_names(TracingFeatureName),
+			start: a._startup_request_id,
+		})
+	}
+
+	if a.features.AccessLog.Enabled {
+		l.Info("[Startup] Access log enabled")
+		features = append(features, &builtinFeature{
+			name:  AccessLogFeatureName,
+			deps:  a._enabled_names(TracingFeatureName, RequestIDFeatureName),
+			start: a._startup_access_log,
+		})
+	}
+
+	if a.features.Gin.Enabled || a.features.HTTP.Enabled {
+		features = append(features, &builtinFeature{
+			name:  RecoveryFeatureName,
+			deps:  a._enabled_names(TracingFeatureName, RequestIDFeatureName, AccessLogFeatureName, MetricsFeatureName),
+			start: a._startup_recovery,
+		})
+	}
+
+	if a.features.Registry.enabled {
+		l.Info("[Startup] registry enabled")
+		features = append(features, &builtinFeature{
+			name:   RegistryFeatureName,
+			start:  a._startup_registry,
+			health: a._health_registry,
+		})
+	}
+
+	if a.features.JWT.Enabled {
+		l.Info("[Startup] JWT enabled")
+		features = append(features, &builtinFeature{
+			name:   JWTFeatureName,
+			deps:   a._enabled_names(GinFeatureName, HTTPFeatureName),
+			start:  a._startup_jwt,
+			run:    a._run_jwt,
+			reload: a._reload_jwt,
+			health: a._health_jwt,
+		})
+	}
+
+	if a.features.RSA.Enabled {
+		l.Info("[Startup] RSA enabled")
+		features = append(features, &builtinFeature{name: RSAFeatureName, start: a._startup_rsa})
+	}
+
+	if a.features.SQL.Enabled {
+		l.Info("[Startup] SQL enabled")
+		features = append(features, &builtinFeature{
+			name:   SQLFeatureName,
+			deps:   a._enabled_names(RegistryFeatureName),
+			start:  a._startup_sql,
+			stop:   a._stop_sql,
+			health: a._health_sql,
+		})
+	}
+
+	if a.features.TLS.Enabled {
+		l.Info("[Startup] TLS enabled")
+		features = append(features, &builtinFeature{
+			name:   TLSFeatureName,
+			start:  a._startup_tls,
+			run:    a._run_tls,
+			stop:   a._stop_tls,
+			reload: a._reload_tls,
+			health: a._health_tls,
+		})
+	}
+
+	if a.features.Gin.Enabled {
+		l.Info("[Startup] Gin enabled")
+		features = append(features, &builtinFeature{
+			name:  GinFeatureName,
+			deps:  a._enabled_names(TLSFeatureName, TracingFeatureName, RequestIDFeatureName, AccessLogFeatureName, RecoveryFeatureName),
+			start: a._startup_gin,
+			run:   a._run_gin,
+			stop:  a._stop_server(GinFeatureName),
+		})
+	}
+
+	if a.features.HTTP.Enabled {
+		l.Info("[Startup] HTTP enabled")
+		features = append(features, &builtinFeature{
+			name:  HTTPFeatureName,
+			deps:  a._enabled_names(TLSFeatureName, TracingFeatureName, RequestIDFeatureName, AccessLogFeatureName, RecoveryFeatureName),
+			start: noop,
+			run:   a._run_http,
+			stop:  a._stop_server(HTTPFeatureName),
+		})
+	}
+
+	if a.features.Metrics.Enabled {
+		l.Info("[Startup] Metrics enabled")
+		features = append(features, &builtinFeature{
+			name:  MetricsFeatureName,
+			deps:  a._enabled_names(TLSFeatureName, TracingFeatureName, RequestIDFeatureName, AccessLogFeatureName),
+			start: a._startup_metrics,
+			run:   a._run_metrics,
+			stop:  a._stop_server(MetricsFeatureName),
+		})
+	}
+
+	if a.features.Docs.Enabled {
+		l.Info("[Startup] Docs enabled")
+		features = append(features, &builtinFeature{
+			name:  DocsFeatureName,
+			deps:  a._enabled_names(GinFeatureName, HTTPFeatureName, MetricsFeatureName),
+			start: a._startup_docs,
+		})
+	}
+
+	if a.features.LoggingAPI.Enabled {
+		l.Info("[Startup] Logging API enabled")
+		features = append(features, &builtinFeature{
+			name:  LoggingAPIFeatureName,
+			deps:  a._enabled_names(TLSFeatureName),
+			start: a._startup_logging_api,
+			stop:  a._stop_server(LoggingAPIFeatureName),
+		})
+	}
+
+	if a.features.Auth.Enabled {
+		l.Info("[Startup] Auth enabled")
+		features = append(features, &builtinFeature{
+			name:  AuthFeatureName,
+			deps:  a._enabled_names(JWTFeatureName, GinFeatureName, HTTPFeatureName),
+			start: a._startup_auth,
+		})
+	}
+
+	if a.features.Health.Enabled {
+		l.Info("[Startup] Health enabled")
+		features = append(features, &builtinFeature{
+			name:  HealthFeatureName,
+			deps:  a._enabled_names(GinFeatureName, HTTPFeatureName, TLSFeatureName, MetricsFeatureName),
+			start: a._startup_health,
+			run:   a._run_health,
+		})
+	}
+
+	return features
+}
+
+// _features returns the built-in features followed by the registered ones.
+func (a *app) _features() ([]Feature, error) {
+	features := a._builtin_features()
+	features = append(features, a.registered...)
+
+	names := map[string]bool{}
+	for _, f := range features {
+		if names[f.Name()] {
+			return nil, fmt.Errorf("feature %s is registered more than once", f.Name())
+		}
+		names[f.Name()] = true
+	}
+
+	return features, nil
+}
@@ -24,6 +24,15 @@ func WithGin(e *gin.Engine) ginOpt {
 	}
 }
 
+func WithGinPort(port int) ginOpt {
+	return ginOpt{
+		featureOpt: featureOpt{
+			key:   gin_portOpt,
+			value: port,
+		},
+	}
+}
+
 func WithGinCors(cors cors.Config) ginOpt {
 	return ginOpt{
 		featureOpt: featureOpt{
@@ -1,8 +1,17 @@
 package app
 
 const (
-	health_pathOpt string = "opt-health-path"
-	health_intervalOpt string = "opt-health-interval"
+	health_pathOpt          string = "opt-health-path"
+	health_intervalOpt      string = "opt-health-interval"
+	health_livenessPathOpt  string = "opt-health-liveness-path"
+	health_readinessPathOpt string = "opt-health-readiness-path"
+	health_startupPathOpt   string = "opt-health-startup-path"
+)
+
+const (
+	DefaultLivenessPath  = "/livez"
+	DefaultReadinessPath = "/readyz"
+	DefaultStartupPath   = "/startupz"
 )
 
 var healthPathFlag string
@@ -29,26 +38,68 @@ func WithHealthInterval(interval int) healthOpt {
 	}
 }
 
+// WithLivenessPath sets the path of the liveness probe, empty disables it.
+func WithLivenessPath(path string) healthOpt {
+	return healthOpt{
+		featureOpt: featureOpt{
+			key:   health_livenessPathOpt,
+			value: path,
+		},
+	}
+}
+
+// WithReadinessPath sets the path of the readiness probe, empty disables it.
+func WithReadinessPath(path string) healthOpt {
+	return healthOpt{
+		featureOpt: featureOpt{
+			key:   health_readinessPathOpt,
+			value: path,
+		},
+	}
+}
+
+// WithStartupPath sets the path of the startup probe, empty disables it.
+func WithStartupPath(path string) healthOpt {
+	return healthOpt{
+		featureOpt: featureOpt{
+			key:   health_startupPathOpt,
+			value: path,
+		},
+	}
+}
+
 type HealthFeature struct {
-	Enabled  bool
-	Path     string
-	Interval int
+	Enabled       bool
+	Path          string
+	Interval      int
+	LivenessPath  string
+	ReadinessPath string
+	StartupPath   string
 }
 
 func (f *HealthFeature) apply(opt healthOpt) {
 	switch opt.key {
 	case health_pathOpt:
-		f.Path = opt.value.(string)	
+		f.Path = opt.value.(string)
 	case health_intervalOpt:
 		f.Interval = opt.value.(int)
+	case health_livenessPathOpt:
+		f.LivenessPath = opt.value.(string)
+	case health_readinessPathOpt:
+		f.ReadinessPath = opt.value.(string)
+	case health_startupPathOpt:
+		f.StartupPath = opt.value.(string)
 	}
 }
 
 func Health(opts ...healthOpt) HealthFeature {
 	f := HealthFeature{
-		Enabled:  true,
-		Path:     healthPathFlag,
-		Interval: 30,
+		Enabled:       true,
+		Path:          healthPathFlag,
+		Interval:      30,
+		LivenessPath:  DefaultLivenessPath,
+		ReadinessPath: DefaultReadinessPath,
+		StartupPath:   DefaultStartupPath,
 	}
 	for _, opt := range opts {
 		f.apply(opt)
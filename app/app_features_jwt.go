@@ -1,6 +1,10 @@
 package app
 
-import "github.com/ooqls/go-crypto/jwt"
+import (
+	"time"
+
+	"github.com/ooqls/go-crypto/jwt"
+)
 
 var jwtPrivKeyPathFlag string
 var jwtPubKeyPathFlag string
@@ -14,6 +18,13 @@ const (
 	jwt_tokenConfigurationOpt     string = "jwt_tokenConfiguration"
 	jwt_privateKeyPathOpt         string = "jwt_privateKeyPath"
 	jwt_publicKeyPathOpt          string = "jwt_publicKeyPath"
+	jwt_jwksPathOpt               string = "jwt_jwksPath"
+	jwt_remoteJWKSOpt             string = "jwt_remoteJWKS"
+	jwt_jwksRefreshOpt            string = "jwt_jwksRefresh"
+	jwt_keyDirOpt                 string = "jwt_keyDir"
+	jwt_previousKeysOpt           string = "jwt_previousKeys"
+	jwt_keyRotationOpt            string = "jwt_keyRotation"
+	jwt_maxPreviousKeysOpt        string = "jwt_maxPreviousKeys"
 )
 
 func WithTokenConfigurationPaths(p []string) jwtOpt {
@@ -52,11 +63,93 @@ func WithJWTPublicKeyPath(p string) jwtOpt {
 	}
 }
 
+// WithJWKSPath sets the path the public keys are served on as a JWKS,
+// /.well-known/jwks.json by default. Empty disables it.
+func WithJWKSPath(path string) jwtOpt {
+	return jwtOpt{
+		featureOpt: featureOpt{
+			key:   jwt_jwksPathOpt,
+			value: path,
+		},
+	}
+}
+
+// WithRemoteJWKS verifies tokens of issuers whose kid is not a key of the app
+// with the keys served at url, e.g. the JWKS of another service. The keys
+// never verify tokens of other issuers. It can be given once per JWKS.
+func WithRemoteJWKS(url string, issuers ...string) jwtOpt {
+	return jwtOpt{
+		featureOpt: featureOpt{
+			key:   jwt_remoteJWKSOpt,
+			value: RemoteJWKS{URL: url, Issuers: issuers},
+		},
+	}
+}
+
+// WithJWKSRefreshInterval sets how often the remote JWKS are fetched, 5
+// minutes by default. A token with an unknown kid fetches them earlier.
+func WithJWKSRefreshInterval(d time.Duration) jwtOpt {
+	return jwtOpt{
+		featureOpt: featureOpt{
+			key:   jwt_jwksRefreshOpt,
+			value: d,
+		},
+	}
+}
+
+// WithJWTKeyDir loads the keys from the .pem files of dir instead of a
+// private and public key path. The newest private key signs tokens, the other
+// keys only verify them. A key is generated into dir when it holds none.
+func WithJWTKeyDir(dir string) jwtOpt {
+	return jwtOpt{
+		featureOpt: featureOpt{
+			key:   jwt_keyDirOpt,
+			value: dir,
+		},
+	}
+}
+
+// WithJWTPreviousKeys verifies tokens with the keys at paths as well, e.g. the
+// keys that signed tokens before the current one. They never sign tokens.
+func WithJWTPreviousKeys(paths ...string) jwtOpt {
+	return jwtOpt{
+		featureOpt: featureOpt{
+			key:   jwt_previousKeysOpt,
+			value: paths,
+		},
+	}
+}
+
+// WithJWTKeyRotation replaces the signing key once it is older than d, the
+// replaced key keeps verifying tokens. With a key dir the new key is written
+// to it, otherwise it does not survive a restart.
+func WithJWTKeyRotation(d time.Duration) jwtOpt {
+	return jwtOpt{
+		featureOpt: featureOpt{
+			key:   jwt_keyRotationOpt,
+			value: d,
+		},
+	}
+}
+
+// WithJWTMaxPreviousKeys sets how many replaced signing keys keep verifying
+// tokens, 2 by default and none when n is 0. On a JWTFeature MaxPreviousKeys
+// 0 keeps the default and a negative value keeps none.
+func WithJWTMaxPreviousKeys(n int) jwtOpt {
+	return jwtOpt{
+		featureOpt: featureOpt{
+			key:   jwt_maxPreviousKeysOpt,
+			value: n,
+		},
+	}
+}
+
 func JWT(opts ...jwtOpt) JWTFeature {
 	f := JWTFeature{
 		Enabled:        true,
 		PrivateKeyPath: jwtPrivKeyPathFlag,
 		PubKeyPath:     jwtPubKeyPathFlag,
+		JWKSPath:       DefaultJWKSPath,
 	}
 
 	for _, opt := range opts {
@@ -70,6 +163,13 @@ type JWTFeature struct {
 	Enabled                 bool
 	PrivateKeyPath          string
 	PubKeyPath              string
+	JWKSPath                string
+	RemoteJWKS              []RemoteJWKS
+	JWKSRefreshInterval     time.Duration
+	KeyDir                  string
+	PreviousKeyPaths        []string
+	RotationInterval        time.Duration
+	MaxPreviousKeys         int
 	tokenConfigurationPaths []string
 	tokenConfiguration      []jwt.TokenConfiguration
 }
@@ -84,5 +184,19 @@ func (f *JWTFeature) apply(opt jwtOpt) {
 		f.tokenConfigurationPaths = opt.value.([]string)
 	case jwt_tokenConfigurationOpt:
 		f.tokenConfiguration = opt.value.([]jwt.TokenConfiguration)
+	case jwt_jwksPathOpt:
+		f.JWKSPath = opt.value.(string)
+	case jwt_remoteJWKSOpt:
+		f.RemoteJWKS = append(f.RemoteJWKS, opt.value.(RemoteJWKS))
+	case jwt_jwksRefreshOpt:
+		f.JWKSRefreshInterval = opt.value.(time.Duration)
+	case jwt_keyDirOpt:
+		f.KeyDir = opt.value.(string)
+	case jwt_previousKeysOpt:
+		f.PreviousKeyPaths = opt.value.([]string)
+	case jwt_keyRotationOpt:
+		f.RotationInterval = opt.value.(time.Duration)
+	case jwt_maxPreviousKeysOpt:
+		f.MaxPreviousKeys = maxPreviousJWTKeys(opt.value.(int))
 	}
 }
@@ -0,0 +1,63 @@
+package app
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const (
+	metrics_portOpt     string = "opt-metrics-port"
+	metrics_pathOpt     string = "opt-metrics-path"
+	metrics_registryOpt string = "opt-metrics-registry"
+)
+
+const DefaultMetricsPath = "/metrics"
+
+type metricsOpt struct {
+	featureOpt
+}
+
+// WithMetricsPort serves the metrics on their own port instead of the gin
+// engine and the http mux.
+func WithMetricsPort(port int) metricsOpt {
+	return metricsOpt{featureOpt: featureOpt{key: metrics_portOpt, value: port}}
+}
+
+func WithMetricsPath(path string) metricsOpt {
+	return metricsOpt{featureOpt: featureOpt{key: metrics_pathOpt, value: path}}
+}
+
+// WithMetricsRegistry sets the registry the metrics are registered with and
+// served from.
+func WithMetricsRegistry(r *prometheus.Registry) metricsOpt {
+	return metricsOpt{featureOpt: featureOpt{key: metrics_registryOpt, value: r}}
+}
+
+type MetricsFeature struct {
+	Enabled  bool
+	Port     int
+	Path     string
+	Registry *prometheus.Registry
+}
+
+func (f *MetricsFeature) apply(opt metricsOpt) {
+	switch opt.key {
+	case metrics_portOpt:
+		f.Port = opt.value.(int)
+	case metrics_pathOpt:
+		f.Path = opt.value.(string)
+	case metrics_registryOpt:
+		f.Registry = opt.value.(*prometheus.Registry)
+	}
+}
+
+func Metrics(opts ...metricsOpt) MetricsFeature {
+	f := MetricsFeature{
+		Enabled:  true,
+		Path:     DefaultMetricsPath,
+		Registry: prometheus.NewRegistry(),
+	}
+
+	for _, opt := range opts {
+		f.apply(opt)
+	}
+
+	return f
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+)
+
+// _ordered_features returns the features sorted so that every feature comes
+// after its dependencies. Features without a dependency between them keep the
+// order they were added in. An unknown dependency or a dependency cycle is
+// reported before any feature is started.
+func (a *app) _ordered_features() ([]Feature, error) {
+	features, err := a._features()
+	if err != nil {
+		return nil, err
+	}
+
+	return orderFeatures(features)
+}
+
+const (
+	unvisited = iota
+	visiting
+	visited
+)
+
+func orderFeatures(features []Feature) ([]Feature, error) {
+	byName := make(map[string]Feature, len(features))
+	for _, f := range features {
+		byName[f.Name()] = f
+	}
+
+	marks := make(map[string]int, len(features))
+	ordered := make([]Feature, 0, len(features))
+	path := []string{}
+
+	var visit func(f Feature) error
+	visit = func(f Feature) error {
+		name := f.Name()
+		switch marks[name] {
+		case visited:
+			return nil
+		case visiting:
+			start := 0
+			for i, n := range path {
+				if n == name {
+					start = i
+					break
+				}
+			}
+			cycle := append(append([]string{}, path[start:]...), name)
+			return fmt.Errorf("dependency cycle between features: %s", strings.Join(cycle, " -> "))
+		}
+
+		marks[name] = visiting
+		path = append(path, name)
+		for _, dep := range f.Dependencies() {
+			d, ok := byName[dep]
+			if !ok {
+				return fmt.Errorf("feature %s depends on unknown feature %s", name, dep)
+			}
+
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[name] = visited
+		ordered = append(ordered, f)
+		return nil
+	}
+
+	for _, f := range features {
+		if err := visit(f); err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
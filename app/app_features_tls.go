@@ -5,6 +5,7 @@ import (
 	"crypto/x509"
 	"fmt"
 	"os"
+	"time"
 )
 
 var (
@@ -20,8 +21,54 @@ const (
 	tls_caBytesOpt  string = "opt-server-ca-bytes"
 	tls_keyFile     string = "opt-server-key-file"
 	tls_keyBytes    string = "opt-server-key-bytes"
+	tls_reloadOpt   string = "opt-server-cert-reload-interval"
+	tls_clientAuth  string = "opt-client-auth"
+	tls_serverAuth  string = "opt-server-client-auth"
+	tls_devCerts    string = "opt-dev-certs"
+	tls_devCertDir  string = "opt-dev-cert-dir"
+	tls_acme        string = "opt-acme"
+	tls_acmeEmail   string = "opt-acme-email"
+	tls_acmeCache   string = "opt-acme-cache-dir"
+	tls_acmeDir     string = "opt-acme-directory-url"
+	tls_acmeHTTP    string = "opt-acme-http-port"
 )
 
+// ClientAuthMode is how a server authenticates the certificates of its clients.
+type ClientAuthMode string
+
+const (
+	// ClientAuthNone does not ask clients for a certificate.
+	ClientAuthNone ClientAuthMode = "none"
+	// ClientAuthRequest asks clients for a certificate but accepts none or
+	// an unverified one.
+	ClientAuthRequest ClientAuthMode = "request"
+	// ClientAuthRequire requires a certificate without verifying it.
+	ClientAuthRequire ClientAuthMode = "require"
+	// ClientAuthVerify requires a certificate signed by the CA of the TLS feature.
+	ClientAuthVerify ClientAuthMode = "verify"
+)
+
+// tlsClientAuth returns the tls.ClientAuthType of m, empty is ClientAuthNone.
+func (m ClientAuthMode) tlsClientAuth() (tls.ClientAuthType, error) {
+	switch m {
+	case "", ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthRequest:
+		return tls.RequestClientCert, nil
+	case ClientAuthRequire:
+		return tls.RequireAnyClientCert, nil
+	case ClientAuthVerify:
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("unknown client auth mode %q, expected none, request, require or verify", string(m))
+	}
+}
+
+type serverClientAuth struct {
+	server string
+	mode   ClientAuthMode
+}
+
 type tlsOpt struct {
 	featureOpt
 }
@@ -98,6 +145,133 @@ func WithKeyBytes(b []byte) tlsOpt {
 	}
 }
 
+// WithCertReloadInterval sets how often the certificate, key and CA files are
+// checked for changes, 10 seconds by default.
+func WithCertReloadInterval(d time.Duration) tlsOpt {
+	return tlsOpt{
+		featureOpt: featureOpt{
+			key:   tls_reloadOpt,
+			value: d,
+		},
+	}
+}
+
+// WithClientAuth sets how all servers authenticate client certificates,
+// ClientAuthVerify needs the CA that signs the client certificates.
+func WithClientAuth(mode ClientAuthMode) tlsOpt {
+	return tlsOpt{
+		featureOpt: featureOpt{
+			key:   tls_clientAuth,
+			value: mode,
+		},
+	}
+}
+
+// WithServerClientAuth overrides the client auth mode of a single server,
+// server is the name of its feature, e.g. LoggingAPIFeatureName.
+func WithServerClientAuth(server string, mode ClientAuthMode) tlsOpt {
+	return tlsOpt{
+		featureOpt: featureOpt{
+			key:   tls_serverAuth,
+			value: serverClientAuth{server: server, mode: mode},
+		},
+	}
+}
+
+// WithDevCerts generates a development CA and a server certificate for
+// localhost and hosts when no certificate is given. The app client trusts
+// the CA, other clients can use it once it is written with WithDevCertDir.
+func WithDevCerts(hosts ...string) tlsOpt {
+	return tlsOpt{
+		featureOpt: featureOpt{
+			key:   tls_devCerts,
+			value: hosts,
+		},
+	}
+}
+
+// WithDevCertDir writes the development certificates to dir as ca.pem,
+// cert.pem and key.pem and reuses them on the next start.
+func WithDevCertDir(dir string) tlsOpt {
+	return tlsOpt{
+		featureOpt: featureOpt{
+			key:   tls_devCertDir,
+			value: dir,
+		},
+	}
+}
+
+// WithACME obtains and renews the certificates of domains from an ACME CA,
+// Let's Encrypt by default.
+func WithACME(domains ...string) tlsOpt {
+	return tlsOpt{
+		featureOpt: featureOpt{
+			key:   tls_acme,
+			value: domains,
+		},
+	}
+}
+
+// WithACMEEmail sets the contact email of the ACME account.
+func WithACMEEmail(email string) tlsOpt {
+	return tlsOpt{
+		featureOpt: featureOpt{
+			key:   tls_acmeEmail,
+			value: email,
+		},
+	}
+}
+
+// WithACMECacheDir caches the ACME account and certificates in dir, so they
+// survive restarts.
+func WithACMECacheDir(dir string) tlsOpt {
+	return tlsOpt{
+		featureOpt: featureOpt{
+			key:   tls_acmeCache,
+			value: dir,
+		},
+	}
+}
+
+// WithACMEDirectoryURL sets the directory of the ACME CA, e.g. the staging
+// environment of Let's Encrypt or a local test CA.
+func WithACMEDirectoryURL(url string) tlsOpt {
+	return tlsOpt{
+		featureOpt: featureOpt{
+			key:   tls_acmeDir,
+			value: url,
+		},
+	}
+}
+
+// WithACMEHTTPPort serves HTTP-01 challenges over plain HTTP on port and
+// redirects every other request to HTTPS.
+func WithACMEHTTPPort(port int) tlsOpt {
+	return tlsOpt{
+		featureOpt: featureOpt{
+			key:   tls_acmeHTTP,
+			value: port,
+		},
+	}
+}
+
+// ACMESettings configures the certificates obtained from an ACME CA.
+type ACMESettings struct {
+	Enabled bool
+	// Domains are the hosts certificates are obtained for.
+	Domains []string
+	Email   string
+	// CacheDir keeps the account and the certificates, they are only kept
+	// in memory when it is empty.
+	CacheDir string
+	// DirectoryURL is the directory of the CA, Let's Encrypt by default.
+	DirectoryURL string
+	// HTTPPort serves HTTP-01 challenges over plain HTTP, 0 disables the
+	// listener. The challenges are served on the HTTP mux and the Gin
+	// engine as well, TLS-ALPN-01 challenges on every TLS listener.
+	HTTPPort int
+}
+
 type TLSFeature struct {
 	Enabled         bool
 	CAFile          string
@@ -106,6 +280,61 @@ type TLSFeature struct {
 	ServerCertBytes []byte
 	ServerKeyBytes  []byte
 	ServerKeyFile   string
+	// ReloadInterval is how often the files are checked for changes, a
+	// changed certificate is used for new connections without a restart.
+	ReloadInterval time.Duration
+	// ClientAuth is how the servers authenticate client certificates, none
+	// by default.
+	ClientAuth ClientAuthMode
+	// ServerClientAuth overrides ClientAuth by server name, e.g. to require
+	// client certificates only on the logging API.
+	ServerClientAuth map[string]ClientAuthMode
+	// DevCerts generates a development certificate when neither
+	// ServerCertFile nor ServerCertBytes are set. It is valid for localhost,
+	// the loopback addresses and DevCertHosts.
+	DevCerts     bool
+	DevCertHosts []string
+	// DevCertDir is where the development certificates are written to and
+	// reused from, they only exist in memory when it is empty.
+	DevCertDir string
+	// ACME obtains the certificates from an ACME CA instead.
+	ACME ACMESettings
+}
+
+// useDevCerts reports whether a development certificate has to be generated.
+func (f *TLSFeature) useDevCerts() bool {
+	return f.DevCerts && !f.ACME.Enabled &&
+		f.ServerCertFile == "" && len(f.ServerCertBytes) == 0 &&
+		f.ServerKeyFile == "" && len(f.ServerKeyBytes) == 0
+}
+
+// clientAuth returns the client auth mode of server.
+func (f *TLSFeature) clientAuth(server string) ClientAuthMode {
+	if mode, ok := f.ServerClientAuth[server]; ok {
+		return mode
+	}
+
+	return f.ClientAuth
+}
+
+// clientCAs returns the pool that client certificates are verified with,
+// only the CA of the feature is trusted.
+func (f *TLSFeature) clientCAs() (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	b := f.CABytes
+	if len(b) == 0 && f.CAFile != "" {
+		var err error
+		b, err = os.ReadFile(f.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file %s: %v", f.CAFile, err)
+		}
+	}
+
+	if len(b) > 0 && !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("failed to add pem bytes of the client ca")
+	}
+
+	return pool, nil
 }
 
 func (f *TLSFeature) TLSConfig() (*tls.Config, error) {
@@ -130,22 +359,46 @@ func (f *TLSFeature) TLSConfig() (*tls.Config, error) {
 		}
 	}
 
-	if len(f.ServerCertFile) > 0 && len(f.ServerKeyFile) > 0 {
-		cert, err := tls.LoadX509KeyPair(f.ServerCertFile, f.ServerKeyFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load x509 key pair: %v", err)
-		}
-		cfg.Certificates = append(cfg.Certificates, cert)
-	} else if len(f.ServerCertBytes) > 0 && len(f.ServerKeyBytes) > 0 {
-		cert, err := tls.X509KeyPair(f.ServerCertBytes, f.ServerKeyBytes)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load x509 key pair: %v", err)
-		}
+	cfg.ClientAuth, err = f.ClientAuth.tlsClientAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ClientCAs, err = f.clientCAs()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok, err := f.keyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
 		cfg.Certificates = append(cfg.Certificates, cert)
 	}
 
 	return cfg, nil
 }
+
+// keyPair loads the server certificate from the files or the bytes, ok is
+// false when neither are given.
+func (f *TLSFeature) keyPair() (cert tls.Certificate, ok bool, err error) {
+	if len(f.ServerCertFile) > 0 && len(f.ServerKeyFile) > 0 {
+		cert, err = tls.LoadX509KeyPair(f.ServerCertFile, f.ServerKeyFile)
+	} else if len(f.ServerCertBytes) > 0 && len(f.ServerKeyBytes) > 0 {
+		cert, err = tls.X509KeyPair(f.ServerCertBytes, f.ServerKeyBytes)
+	} else {
+		return cert, false, nil
+	}
+
+	if err != nil {
+		return cert, false, fmt.Errorf("failed to load x509 key pair: %v", err)
+	}
+
+	return cert, true, nil
+}
+
 func TLS(opts ...tlsOpt) TLSFeature {
 	f := TLSFeature{
 		Enabled: true,
@@ -165,6 +418,32 @@ func TLS(opts ...tlsOpt) TLSFeature {
 			f.ServerKeyFile = opt.value.(string)
 		case tls_keyBytes:
 			f.ServerKeyBytes = opt.value.([]byte)
+		case tls_reloadOpt:
+			f.ReloadInterval = opt.value.(time.Duration)
+		case tls_clientAuth:
+			f.ClientAuth = opt.value.(ClientAuthMode)
+		case tls_serverAuth:
+			sa := opt.value.(serverClientAuth)
+			if f.ServerClientAuth == nil {
+				f.ServerClientAuth = map[string]ClientAuthMode{}
+			}
+			f.ServerClientAuth[sa.server] = sa.mode
+		case tls_devCerts:
+			f.DevCerts = true
+			f.DevCertHosts = append(f.DevCertHosts, opt.value.([]string)...)
+		case tls_devCertDir:
+			f.DevCertDir = opt.value.(string)
+		case tls_acme:
+			f.ACME.Enabled = true
+			f.ACME.Domains = append(f.ACME.Domains, opt.value.([]string)...)
+		case tls_acmeEmail:
+			f.ACME.Email = opt.value.(string)
+		case tls_acmeCache:
+			f.ACME.CacheDir = opt.value.(string)
+		case tls_acmeDir:
+			f.ACME.DirectoryURL = opt.value.(string)
+		case tls_acmeHTTP:
+			f.ACME.HTTPPort = opt.value.(int)
 		}
 	}
 
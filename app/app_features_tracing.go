@@ -0,0 +1,107 @@
+package app
+
+import (
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	tracing_exporterOpt     string = "opt-tracing-exporter"
+	tracing_endpointOpt     string = "opt-tracing-endpoint"
+	tracing_insecureOpt     string = "opt-tracing-insecure"
+	tracing_fileOpt         string = "opt-tracing-file"
+	tracing_sampleRatioOpt  string = "opt-tracing-sample-ratio"
+	tracing_serviceNameOpt  string = "opt-tracing-service-name"
+	tracing_spanExporterOpt string = "opt-tracing-span-exporter"
+)
+
+// Exporters the tracing feature can send spans to.
+const (
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+	TracingExporterFile   = "file"
+)
+
+type tracingOpt struct {
+	featureOpt
+}
+
+// WithTracingExporter selects the exporter of the spans, one of otlp, stdout or file.
+func WithTracingExporter(exporter string) tracingOpt {
+	return tracingOpt{featureOpt: featureOpt{key: tracing_exporterOpt, value: exporter}}
+}
+
+// WithOTLPEndpoint sets the host:port of the OTLP/HTTP collector.
+func WithOTLPEndpoint(endpoint string) tracingOpt {
+	return tracingOpt{featureOpt: featureOpt{key: tracing_endpointOpt, value: endpoint}}
+}
+
+// WithOTLPInsecure sends the spans to the OTLP collector without TLS.
+func WithOTLPInsecure() tracingOpt {
+	return tracingOpt{featureOpt: featureOpt{key: tracing_insecureOpt, value: true}}
+}
+
+// WithTracingFile writes the spans as JSON to path, it implies the file exporter.
+func WithTracingFile(path string) tracingOpt {
+	return tracingOpt{featureOpt: featureOpt{key: tracing_fileOpt, value: path}}
+}
+
+// WithTracingSampleRatio samples the given fraction of the traces that are
+// started by the app. Traces started by a caller follow the caller's decision.
+func WithTracingSampleRatio(ratio float64) tracingOpt {
+	return tracingOpt{featureOpt: featureOpt{key: tracing_sampleRatioOpt, value: ratio}}
+}
+
+// WithTracingServiceName sets the service name of the spans, the app name by default.
+func WithTracingServiceName(name string) tracingOpt {
+	return tracingOpt{featureOpt: featureOpt{key: tracing_serviceNameOpt, value: name}}
+}
+
+// WithSpanExporter sends the spans to exporter instead of the configured one.
+func WithSpanExporter(exporter sdktrace.SpanExporter) tracingOpt {
+	return tracingOpt{featureOpt: featureOpt{key: tracing_spanExporterOpt, value: exporter}}
+}
+
+type TracingFeature struct {
+	Enabled      bool
+	Exporter     string
+	Endpoint     string
+	Insecure     bool
+	File         string
+	SampleRatio  float64
+	ServiceName  string
+	SpanExporter sdktrace.SpanExporter
+}
+
+func (f *TracingFeature) apply(opt tracingOpt) {
+	switch opt.key {
+	case tracing_exporterOpt:
+		f.Exporter = opt.value.(string)
+	case tracing_endpointOpt:
+		f.Endpoint = opt.value.(string)
+	case tracing_insecureOpt:
+		f.Insecure = opt.value.(bool)
+	case tracing_fileOpt:
+		f.Exporter = TracingExporterFile
+		f.File = opt.value.(string)
+	case tracing_sampleRatioOpt:
+		f.SampleRatio = opt.value.(float64)
+	case tracing_serviceNameOpt:
+		f.ServiceName = opt.value.(string)
+	case tracing_spanExporterOpt:
+		f.SpanExporter = opt.value.(sdktrace.SpanExporter)
+	}
+}
+
+func Tracing(opts ...tracingOpt) TracingFeature {
+	f := TracingFeature{
+		Enabled:     true,
+		Exporter:    TracingExporterOTLP,
+		SampleRatio: 1,
+	}
+
+	for _, opt := range opts {
+		f.apply(opt)
+	}
+
+	return f
+}
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const defaultHealthInterval = 30 * time.Second
+
+// _refresh_health evaluates the health checks and caches the report, changes
+// of the status are logged.
+func (a *app) _refresh_health(ctx context.Context) HealthReport {
+	l := a.l
+	report := a._evaluate_health(ctx)
+	if a.healthCheck != nil && !a.healthCheck() {
+		report.Status = HealthStatusError
+	}
+
+	prev := a.healthReport.Swap(&report)
+	if prev == nil || prev.Status != report.Status {
+		from := HealthStatus("unknown")
+		if prev != nil {
+			from = prev.Status
+		}
+
+		if report.Status == HealthStatusOK {
+			l.Info("[Health] health status changed", zap.String("from", string(from)), zap.String("to", string(report.Status)))
+		} else {
+			l.Warn("[Health] health status changed", zap.String("from", string(from)), zap.String("to", string(report.Status)))
+		}
+	}
+
+	if prev == nil || prev.Status != report.Status {
+		a.state.setHealth(report.Status)
+	}
+
+	return report
+}
+
+// _check_health returns the cached health report. The app is not healthy
+// before the checks ran for the first time.
+func (a *app) _check_health(ctx context.Context) HealthReport {
+	report := a.healthReport.Load()
+	if report == nil {
+		return statusReport(false)
+	}
+
+	return *report
+}
+
+// _check_liveness reports whether the process is able to serve at all.
+func (a *app) _check_liveness(ctx context.Context) HealthReport {
+	return statusReport(a.healthCheck == nil || a.healthCheck())
+}
+
+// _check_startup reports whether the startup of the app has completed.
+func (a *app) _check_startup(ctx context.Context) HealthReport {
+	switch a.state.phase() {
+	case PhaseRunning, PhaseDraining, PhaseStopped:
+		return statusReport(true)
+	}
+
+	return statusReport(false)
+}
+
+// _check_readiness reports whether the app is running, not shutting down and
+// every critical health check passes.
+func (a *app) _check_readiness(ctx context.Context) HealthReport {
+	if a.state.phase() != PhaseRunning {
+		return statusReport(false)
+	}
+
+	return a._check_health(ctx)
+}
+
+// _handle_probe serves check on path on the gin engine and the http mux. The
+// results of the single checks are only included with the verbose query parameter.
+func (a *app) _handle_probe(path string, failStatus int, check func(ctx context.Context) HealthReport) {
+	if path == "" {
+		return
+	}
+
+	respond := func(ctx context.Context, verbose bool) (int, HealthReport) {
+		report := check(ctx)
+		if !verbose {
+			report.Checks = nil
+		}
+
+		if report.Status == HealthStatusError {
+			return failStatus, report
+		}
+
+		return http.StatusOK, report
+	}
+
+	if a.features.Gin.Enabled {
+		a.features.Gin.Engine.GET(path, func(ctx *gin.Context) {
+			_, verbose := ctx.GetQuery("verbose")
+			ctx.JSON(respond(ctx.Request.Context(), verbose))
+		})
+	}
+
+	if a.features.HTTP.Enabled {
+		a.features.HTTP.Mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			status, report := respond(r.Context(), r.URL.Query().Has("verbose"))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(report)
+		})
+	}
+}
+
+func (a *app) _startup_health(ctx *AppContext) error {
+	l := ctx.L()
+	f := a.features.Health
+	l.Info("[Startup Health] initializing health with path", zap.String("path", f.Path),
+		zap.String("liveness_path", f.LivenessPath),
+		zap.String("readiness_path", f.ReadinessPath),
+		zap.String("startup_path", f.StartupPath))
+
+	a._handle_probe(f.Path, http.StatusInternalServerError, a._check_health)
+	a._handle_probe(f.LivenessPath, http.StatusServiceUnavailable, a._check_liveness)
+	a._handle_probe(f.ReadinessPath, http.StatusServiceUnavailable, a._check_readiness)
+	a._handle_probe(f.StartupPath, http.StatusServiceUnavailable, a._check_startup)
+
+	return nil
+}
+
+// healthInterval returns the interval of the health checks, seconds <= 0
+// returns the default interval.
+func healthInterval(seconds int) time.Duration {
+	if seconds <= 0 {
+		return defaultHealthInterval
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// _run_health evaluates the health checks in the background on every interval,
+// the interval can change when the config is reloaded.
+func (a *app) _run_health(ctx *AppContext) error {
+	a.threadWg.Add(1)
+	go func() {
+		defer a.threadWg.Done()
+		ticker := time.NewTicker(healthInterval(a.features.Health.Interval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case interval := <-a.healthInterval:
+				ticker.Reset(interval)
+			case <-ticker.C:
+				a._refresh_health(ctx)
+			}
+		}
+	}()
+
+	return nil
+}
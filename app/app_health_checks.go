@@ -0,0 +1,207 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultHealthCheckTimeout = 5 * time.Second
+
+type HealthStatus string
+
+const (
+	HealthStatusOK       HealthStatus = "ok"
+	HealthStatusDegraded HealthStatus = "degraded"
+	HealthStatusError    HealthStatus = "error"
+)
+
+// HealthCheckResult is the outcome of the last run of a health check.
+type HealthCheckResult struct {
+	Name      string       `json:"name"`
+	Status    HealthStatus `json:"status"`
+	Critical  bool         `json:"critical"`
+	Latency   string       `json:"latency"`
+	Error     string       `json:"error,omitempty"`
+	LastError string       `json:"last_error,omitempty"`
+	CheckedAt time.Time    `json:"checked_at"`
+}
+
+// HealthReport is the combined result of all health checks. The status is
+// error when a critical check fails and degraded when only non-critical ones do.
+type HealthReport struct {
+	Status HealthStatus        `json:"status"`
+	Checks []HealthCheckResult `json:"checks,omitempty"`
+}
+
+func statusReport(ok bool) HealthReport {
+	if ok {
+		return HealthReport{Status: HealthStatusOK}
+	}
+
+	return HealthReport{Status: HealthStatusError}
+}
+
+const (
+	healthCheck_timeoutOpt  string = "opt-health-check-timeout"
+	healthCheck_criticalOpt string = "opt-health-check-critical"
+)
+
+type healthCheckOpt struct {
+	featureOpt
+}
+
+// WithHealthCheckTimeout sets the time a health check is given, 5 seconds by default.
+func WithHealthCheckTimeout(d time.Duration) healthCheckOpt {
+	return healthCheckOpt{
+		featureOpt: featureOpt{
+			key:   healthCheck_timeoutOpt,
+			value: d,
+		},
+	}
+}
+
+// WithHealthCheckCritical sets whether a failing check makes the app unhealthy.
+// Checks are critical by default, failing non-critical checks only degrade the app.
+func WithHealthCheckCritical(critical bool) healthCheckOpt {
+	return healthCheckOpt{
+		featureOpt: featureOpt{
+			key:   healthCheck_criticalOpt,
+			value: critical,
+		},
+	}
+}
+
+type healthCheck struct {
+	name     string
+	check    func(ctx context.Context) error
+	timeout  time.Duration
+	critical bool
+
+	m         sync.Mutex
+	lastError string
+}
+
+func (c *healthCheck) apply(opt healthCheckOpt) {
+	switch opt.key {
+	case healthCheck_timeoutOpt:
+		c.timeout = opt.value.(time.Duration)
+	case healthCheck_criticalOpt:
+		c.critical = opt.value.(bool)
+	}
+}
+
+// run calls the check and gives up once the timeout is reached, even if the
+// check does not respect the context.
+func (c *healthCheck) run(ctx context.Context) HealthCheckResult {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := HealthCheckResult{
+		Name:      c.name,
+		Status:    HealthStatusOK,
+		Critical:  c.critical,
+		Latency:   time.Since(start).String(),
+		CheckedAt: start,
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err != nil {
+		result.Status = HealthStatusError
+		result.Error = err.Error()
+		c.lastError = err.Error()
+	}
+	result.LastError = c.lastError
+
+	return result
+}
+
+// AddHealthCheck adds a named check that is evaluated by the health and
+// readiness endpoints. A check with the same name replaces the existing one.
+func (a *app) AddHealthCheck(name string, check func(ctx context.Context) error, opts ...healthCheckOpt) *app {
+	c := &healthCheck{
+		name:     name,
+		check:    check,
+		timeout:  defaultHealthCheckTimeout,
+		critical: true,
+	}
+
+	for _, opt := range opts {
+		c.apply(opt)
+	}
+
+	a.healthM.Lock()
+	defer a.healthM.Unlock()
+	for i, existing := range a.healthChecks {
+		if existing.name == name {
+			a.healthChecks[i] = c
+			return a
+		}
+	}
+	a.healthChecks = append(a.healthChecks, c)
+
+	return a
+}
+
+// _add_feature_check registers the health of a started feature as a check.
+func (a *app) _add_feature_check(f Feature) {
+	if bf, ok := f.(*builtinFeature); ok && bf.health == nil {
+		return
+	}
+
+	a.AddHealthCheck(f.Name(), f.Health)
+}
+
+// _evaluate_health runs all health checks concurrently.
+func (a *app) _evaluate_health(ctx context.Context) HealthReport {
+	a.healthM.RLock()
+	checks := append([]*healthCheck{}, a.healthChecks...)
+	a.healthM.RUnlock()
+
+	report := HealthReport{
+		Status: HealthStatusOK,
+		Checks: make([]HealthCheckResult, len(checks)),
+	}
+
+	wg := sync.WaitGroup{}
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Checks[i] = c.run(ctx)
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if result.Status == HealthStatusOK {
+			continue
+		}
+
+		a.l.Warn("[Health] health check failed", zap.String("check", result.Name),
+			zap.Bool("critical", result.Critical), zap.String("error", result.Error))
+		if result.Critical {
+			report.Status = HealthStatusError
+		} else if report.Status == HealthStatusOK {
+			report.Status = HealthStatusDegraded
+		}
+	}
+
+	return report
+}
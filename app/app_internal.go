@@ -2,18 +2,21 @@ package app
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/ooqls/go-crypto/jwt"
 	"github.com/ooqls/go-crypto/keys"
 	v1 "github.com/ooqls/go-log/api/v1"
 	"github.com/ooqls/go-registry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -24,38 +27,46 @@ func (a *app) _start_http_server(ctx *AppContext, handler http.Handler, port int
 		Handler: handler,
 	}
 	if a.features.TLS.Enabled {
-		tlsConfig, err := a.features.TLS.TLSConfig()
+		clientAuth, err := a.features.TLS.clientAuth(name).tlsClientAuth()
 		if err != nil {
-			l.Error("[Startup docs] encountered an error on startup", zap.Error(err))
+			l.Error("[Startup http] invalid client auth", zap.Error(err), zap.String("name", name))
 			return err
 		}
-		srv.TLSConfig = tlsConfig
+		srv.TLSConfig = a.certs.serverConfig(clientAuth)
 	}
 
+	return a._serve(ctx, srv, name)
+}
+
+// _serve runs srv in the background, with TLS when it has a TLS config. The
+// address is bound before it returns, so the app only reports running once
+// its servers accept connections.
+func (a *app) _serve(ctx *AppContext, srv *http.Server, name string) error {
+	l := ctx.L()
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		l.Error("[Startup http] failed to listen", zap.Error(err), zap.String("name", name))
+		return fmt.Errorf("server %s failed to listen: %w", name, err)
+	}
+	a.servers[name] = srv
+
 	a.threadWg.Add(1)
 	go func() {
 		defer a.threadWg.Done()
-		if a.features.TLS.Enabled {
-			err := srv.ListenAndServeTLS("", "")
-			if err != nil && err != http.ErrServerClosed {
-				l.Error("[Startup http] encountered an error on startup",
-					zap.Error(err), zap.String("name", name))
-				return
-			}
-		} else {
-			err := srv.ListenAndServe()
-			if err != nil && err != http.ErrServerClosed {
-				l.Error("[Startup http] encountered an error on startup",
-					zap.Error(err), zap.String("name", name))
-				return
+		serve := srv.Serve
+		if srv.TLSConfig != nil {
+			serve = func(ln net.Listener) error { return srv.ServeTLS(ln, "", "") }
+		}
+		if err := serve(ln); err != nil && err != http.ErrServerClosed {
+			l.Error("[Startup http] encountered an error on startup",
+				zap.Error(err), zap.String("name", name))
+			select {
+			case a.serveErrs <- fmt.Errorf("server %s exited: %w", name, err):
+			default:
 			}
 		}
 	}()
 
-	a.stopServers = append(a.stopServers, func() (string, error) {
-		return name, srv.Shutdown(ctx)
-	})
-
 	return nil
 }
 
@@ -72,89 +83,98 @@ func (a *app) _startup_docs(ctx *AppContext) error {
 		a.Features().Gin.Engine.StaticFS(a.features.Docs.DocsApiPath, http.FS(os.DirFS(a.features.Docs.DocsPath)))
 	}
 
-	a.state.DocsInitialized = true
+	a.state.set(func(s *AppState) { s.DocsInitialized = true })
 	return nil
 }
 
 func (a *app) _startup_tls(ctx *AppContext) error {
+	if a.features.TLS.useDevCerts() {
+		if err := a._startup_dev_certs(ctx); err != nil {
+			return err
+		}
+	}
+
 	f := a.features.TLS
 	l := ctx.L()
-	cfg := &tls.Config{}
-
-	pool, err := x509.SystemCertPool()
-	if err != nil {
-		return fmt.Errorf("failed to get system cert pool: %v", err)
-	}
 
 	if len(f.CABytes) > 0 {
 		l.Info("[Startup TLS] using CA bytes in tls config")
-		ok := pool.AppendCertsFromPEM(f.CABytes)
-		if !ok {
-			return fmt.Errorf("failed to append all ca bytes")
-		}
 	} else if f.CAFile != "" {
 		l.Info("[Startup TLS] Using CA file for tls config", zap.String("ca", f.CAFile))
-		b, err := os.ReadFile(f.CAFile)
-		if err != nil {
-			return fmt.Errorf("failed to read ca file %s: %v", f.CAFile, err)
-		}
-
-		ok := pool.AppendCertsFromPEM(b)
-		if !ok {
-			return fmt.Errorf("failed to add pem bytes from ca file %s", f.CAFile)
-		}
 	} else {
 		l.Info("[Startup TLS] No CA given")
 	}
-	cfg.ClientCAs = pool
-	cfg.RootCAs = pool
-
-	var tlsCert tls.Certificate
-	var keyBytes []byte
-	var certBytes []byte
 
 	if len(f.ServerCertBytes) > 0 {
 		l.Info("[Startup TLS] server cert bytes given")
-		certBytes = f.ServerCertBytes
 	} else if f.ServerCertFile != "" {
 		l.Info("[Startup TLS] server cert file given", zap.String("cert_file", f.ServerCertFile))
-		certBytes, err = os.ReadFile(f.ServerCertFile)
-		if err != nil {
-			return fmt.Errorf("failed to read cert file %s: %v", f.ServerCertFile, err)
-		}
-	} else {
-		return fmt.Errorf("no server cert given for TLS")
 	}
 
 	if len(f.ServerKeyBytes) > 0 {
 		l.Info("[Startup TLS] server key bytes given")
-		keyBytes = f.ServerKeyBytes
 	} else if f.ServerKeyFile != "" {
 		l.Info("[Startup TLS] server key file given", zap.String("key_file", f.ServerKeyFile))
-		keyBytes, err = os.ReadFile(f.ServerKeyFile)
-		if err != nil {
-			return fmt.Errorf("failed to read key file %s: %v", f.ServerKeyFile, err)
+	}
+
+	modes := map[string]ClientAuthMode{"default": f.ClientAuth}
+	for server, mode := range f.ServerClientAuth {
+		modes[server] = mode
+	}
+	for server, mode := range modes {
+		if _, err := mode.tlsClientAuth(); err != nil {
+			return err
+		}
+		if mode == ClientAuthVerify && len(f.CABytes) == 0 && f.CAFile == "" {
+			return fmt.Errorf("client auth verify needs a CA to verify client certificates with")
+		}
+		if mode != "" && mode != ClientAuthNone {
+			l.Info("[Startup TLS] client auth enabled", zap.String("server", server), zap.String("mode", string(mode)))
 		}
-	} else {
-		return fmt.Errorf("no server key gven for tls")
 	}
 
-	if len(keyBytes) > 0 && len(certBytes) > 0 {
+	a.certs = newCertReloader(f, l, a._set_cert_expiry)
+	if f.ACME.Enabled {
+		l.Info("[Startup TLS] using ACME certificates", zap.Strings("domains", f.ACME.Domains))
+		a.certs.acme = a._acme_manager(ctx)
+	} else {
 		l.Info("[Startup TLS] Loading key pair...")
-		tlsCert, err = tls.X509KeyPair(certBytes, keyBytes)
-		if err != nil {
-			return fmt.Errorf("failed to load key pair: %v", err)
+	}
+	if err := a.certs.reload(); err != nil {
+		return err
+	}
+
+	if f.ACME.Enabled {
+		if err := a._startup_acme(ctx); err != nil {
+			return err
 		}
-		cfg.Certificates = append(cfg.Certificates, tlsCert)
 	}
 
 	a.httpClient = &http.Client{
 		Transport: &http.Transport{
-			TLSClientConfig: cfg,
+			TLSClientConfig: a.certs.clientConfig(),
 		},
 	}
 
-	a.state.TLSInitialized = true
+	a.state.set(func(s *AppState) { s.TLSInitialized = true })
+	return nil
+}
+
+// _health_tls reports the TLS feature as unhealthy once the server certificate expired.
+func (a *app) _health_tls(ctx context.Context) error {
+	cert := a.certs.Leaf()
+	if cert == nil && a.certs.acme != nil {
+		// ACME certificates are obtained on the first handshake
+		return nil
+	}
+	if cert == nil {
+		return fmt.Errorf("no server certificate loaded")
+	}
+
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("server certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+
 	return nil
 }
 
@@ -163,13 +183,13 @@ func (a *app) _startup_logging_api(ctx *AppContext) error {
 
 	l.Debug("[Startup Logging API] adding logging routes")
 	handler := v1.Std()
-	err := a._start_http_server(ctx, handler, a.features.LoggingAPI.Port, "logging-api")
+	err := a._start_http_server(ctx, handler, a.features.LoggingAPI.Port, LoggingAPIFeatureName)
 	if err != nil {
 		l.Error("[Startup Logging API] encountered an error on startup", zap.Error(err))
 		return err
 	}
 	l.Debug("[Startup Logging API] finished adding logging routes")
-	a.state.LoggingAPIInitialized = true
+	a.state.set(func(s *AppState) { s.LoggingAPIInitialized = true })
 	return nil
 }
 
@@ -200,7 +220,7 @@ func (a *app) _startup_rsa(ctx *AppContext) error {
 			return err
 		}
 
-		a.state.RSAInitialized = true
+		a.state.set(func(s *AppState) { s.RSAInitialized = true })
 		l.Debug("[Startup RSA] RSA keys initialized successfully")
 	} else {
 		l.Debug("[Startup RSA] no RSA key paths provided")
@@ -211,69 +231,63 @@ func (a *app) _startup_rsa(ctx *AppContext) error {
 		keys.SetRSA(rsa)
 	}
 
-	a.state.RSAInitialized = true
+	a.state.set(func(s *AppState) { s.RSAInitialized = true })
 	return nil
 }
 
-func (a *app) _startup_jwt(ctx *AppContext) error {
-	l := ctx.L()
-
-	configs := a.features.JWT.tokenConfiguration
-	configPaths := a.features.JWT.tokenConfigurationPaths
-	privKeyPath := a.features.JWT.PrivateKeyPath
-	pubKeyPath := a.features.JWT.PubKeyPath
-
-	if privKeyPath != "" && pubKeyPath != "" {
-
-		if !fileExists(privKeyPath) {
-			l.Info("[Startup JWT] JWT private key does not exist", zap.String("path", privKeyPath))
-			return nil
-		}
-
-		if !fileExists(pubKeyPath) {
-			l.Info("[Startup JWT] JWT public key does not exist", zap.String("path", pubKeyPath))
-			return nil
-		}
-		l.Debug("[Startup JWT] initializing JWT keys with paths",
-			zap.String("jwt_private_key_path", privKeyPath),
-			zap.String("jwt_pub_key_path", pubKeyPath),
-		)
-		jwtPrivKey := mustReadFile(privKeyPath)
-		jwtPubKey := mustReadFile(pubKeyPath)
-		if err := keys.InitJwt(jwtPrivKey, jwtPubKey); err != nil {
-			return err
-		}
-
-		a.state.JWTInitialized = true
-		l.Debug("[Startup JWT] JWT keys initialized successfully")
-	} else {
-		l.Debug("[Startup JWT] no JWT key paths provided, creating a key...")
-		rsaKey, err := keys.NewRSA()
-		if err != nil {
-			return err
-		}
-		jwtKey := keys.NewJWTKey(*rsaKey)
-		keys.SetJwt(jwtKey)
-	}
-
-	for _, configPath := range configPaths {
+// loadTokenConfigs returns the token configurations of the files at paths and
+// configs by issuer, configs override the files.
+func loadTokenConfigs(paths []string, configs []jwt.TokenConfiguration) (map[string]jwt.TokenConfiguration, error) {
+	tokenConfigs := map[string]jwt.TokenConfiguration{}
+	for _, configPath := range paths {
 		if !fileExists(configPath) {
-			l.Error("[Startup JWT] JWT token config file not found", zap.String("path", configPath))
-			return fmt.Errorf("JWT token config file not found: %s", configPath)
+			return nil, fmt.Errorf("JWT token config file not found: %s", configPath)
 		}
 
 		config, err := jwt.ParseTokenConfigFile(configPath)
 		if err != nil {
-			return fmt.Errorf("failed to parse token config file %s: %v", configPath, err)
+			return nil, fmt.Errorf("failed to parse token config file %s: %v", configPath, err)
 		}
-		ctx.issuerToTokenConfigs[config.Issuer] = *config
+		tokenConfigs[config.Issuer] = *config
 	}
 
 	for _, cfg := range configs {
-		ctx.issuerToTokenConfigs[cfg.Issuer] = cfg
+		tokenConfigs[cfg.Issuer] = cfg
+	}
+
+	return tokenConfigs, nil
+}
+
+func (a *app) _startup_jwt(ctx *AppContext) error {
+	l := ctx.L()
+
+	configs := a.features.JWT.tokenConfiguration
+	configPaths := a.features.JWT.tokenConfigurationPaths
+	signing, previous, static, err := a._load_jwt_keys(l)
+	if err != nil {
+		l.Error("[Startup JWT] failed to load JWT keys", zap.Error(err))
+		return err
+	}
+	if err := a._use_jwt_key(signing); err != nil {
+		return err
+	}
+
+	tokenConfigs, err := loadTokenConfigs(configPaths, configs)
+	if err != nil {
+		l.Error("[Startup JWT] failed to load token configurations", zap.Error(err))
+		return err
 	}
+	ctx.setTokenConfigs(tokenConfigs)
 
-	a.state.JWTInitialized = true
+	ctx.jwtKeys = newJWTKeys(signing, nil, static, a.features.JWT.RemoteJWKS)
+	ctx.jwtKeys.set(signing, previous, a._max_previous_jwt_keys())
+	l.Info("[Startup JWT] signing tokens", zap.String("kid", signing.kid), zap.Int("verification_keys", len(ctx.jwtKeys.all())-1))
+	if path := a.features.JWT.JWKSPath; path != "" {
+		l.Debug("[Startup JWT] serving jwks", zap.String("path", path))
+		a._handle_jwks(ctx, path)
+	}
+
+	a.state.set(func(s *AppState) { s.JWTInitialized = true })
 	return nil
 }
 
@@ -292,245 +306,166 @@ func (a *app) _startup_registry(ctx *AppContext) error {
 			l.Error("[Startup Registry] failed to initialize registry", zap.Error(err))
 			return err
 		}
-		a.state.RegistryInitialized = true
+		a.state.set(func(s *AppState) { s.RegistryInitialized = true })
 		l.Debug("[Startup Registry] registry initialized successfully")
 
 	} else {
 		l.Debug("[Startup Registry] no registry path provided, using localhost")
 		registry.InitLocalhost()
 	}
-	a.state.RegistryInitialized = true
+	a.state.set(func(s *AppState) { s.RegistryInitialized = true })
 	return nil
 
 }
 
-func (a *app) _startup_health(ctx *AppContext) error {
-	l := ctx.L()
-	l.Info("[Startup Health] initializing health with path", zap.String("path", a.features.Health.Path))
-	port := 8080
-	if a.features.Gin.Enabled {
-		port = a.features.Gin.Port
-		e := a.features.Gin.Engine
-		e.GET(a.features.Health.Path, func(ctx *gin.Context) {
-			if a.healthCheck != nil {
-				if a.healthCheck() {
-					ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
-					a.state.Healthy = true
-				} else {
-					ctx.JSON(http.StatusInternalServerError, gin.H{"status": "error"})
-					a.state.Healthy = false
-				}
-			} else {
-				ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
-				a.state.Healthy = true
-			}
-		})
-	}
-
-	if a.features.HTTP.Enabled {
-		port = a.features.HTTP.Port
-		a.features.HTTP.Mux.HandleFunc(a.features.Health.Path, func(w http.ResponseWriter, r *http.Request) {
-			if a.healthCheck != nil {
-				if a.healthCheck() {
-					w.WriteHeader(http.StatusOK)
-					a.state.Healthy = true
-				} else {
-					w.WriteHeader(http.StatusInternalServerError)
-					a.state.Healthy = false
-				}
-			} else {
-				w.WriteHeader(http.StatusOK)
-				a.state.Healthy = true
-			}
-		})
+// _health_registry reports the registry as unhealthy when its file disappeared.
+func (a *app) _health_registry(ctx context.Context) error {
+	p := a.features.Registry.RegistryPath()
+	if p != "" && !fileExists(p) {
+		return ErrRegistryFileNotFound
 	}
 
-	a.threadWg.Add(1)
-	go func() {
-		protocol := "http"
-		if a.features.TLS.Enabled {
-			protocol = "https"
-		}
+	return nil
+}
 
-		defer a.threadWg.Done()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-time.After(time.Duration(a.features.Health.Interval) * time.Second):
-				url := fmt.Sprintf("%s://localhost:%d%s",
-					protocol,
-					port, a.features.Health.Path)
-				_, err := a.httpClient.Get(url)
-				if err != nil {
-					l.Error("[Startup Health] got an error from health check", zap.Error(err))
-				}
-			}
+func (a *app) _startup_gin(ctx *AppContext) error {
+	if err := a._set_cors(a.features.Gin.Cors); err != nil {
+		return err
+	}
+
+	ctx.L().Debug("[Startup Gin] adding cors middleware")
+	a.features.Gin.Engine.Use(func(c *gin.Context) {
+		if h := a.cors.Load(); h != nil {
+			(*h)(c)
 		}
-	}()
+	})
 
 	return nil
+}
+
+// _set_cors replaces the cors middleware of the gin engine, nil disables cors.
+func (a *app) _set_cors(cfg *cors.Config) error {
+	h, err := corsHandler(cfg)
+	if err != nil {
+		return err
+	}
+	a.cors.Store(h)
 
+	return nil
 }
 
-func (a *app) _run_gin(ctx *AppContext) error {
-	l := a.l
-	server := &http.Server{
-		Addr:    fmt.Sprintf("0.0.0.0:%d", a.features.Gin.Port),
-		Handler: a.features.Gin.Engine,
+// corsHandler returns the handler of cfg, nil when cfg is nil.
+func corsHandler(cfg *cors.Config) (*gin.HandlerFunc, error) {
+	if cfg == nil {
+		return nil, nil
 	}
 
-	if a.features.TLS.Enabled {
-		tlsConfig, err := a.features.TLS.TLSConfig()
-		if err != nil {
-			l.Error("[Running Gin] Failed to get TLS config", zap.Error(err))
-			return err
-		}
-		server.TLSConfig = tlsConfig
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid cors config: %v", err)
 	}
-	a.threadWg.Add(2)
+	h := cors.New(*cfg)
 
-	go func() {
-		defer a.threadWg.Done()
-		if a.features.TLS.Enabled {
-			l.Debug("[Running Gin] Starting HTTPS server with Gin")
-			err := server.ListenAndServeTLS("", "")
-			if err != nil {
-				l.Error("[Running Gin] encountered an error on listen and serve", zap.Error(err))
-				return
-			}
-		} else {
-			l.Debug("[Running Gin] Starting HTTP server with Gin")
-			err := server.ListenAndServe()
-			if err != nil {
-				l.Error("[Running Gin] encountered an error on listen and serve", zap.Error(err))
-				return
-			}
-		}
-	}()
-	go func() {
-		defer a.threadWg.Done()
-		<-ctx.Done()
-		err := server.Shutdown(ctx)
-		if err != nil {
-			l.Error("[Running Gin] encountered an error on startup", zap.Error(err))
-			return
-		}
-	}()
+	return &h, nil
+}
+
+func (a *app) _run_gin(ctx *AppContext) error {
+	l := a.l
+	l.Debug("[Running Gin] Starting server with Gin", zap.Bool("tls", a.features.TLS.Enabled))
+	err := a._start_http_server(ctx, a.features.Gin.Engine, a.features.Gin.Port, GinFeatureName)
+	if err != nil {
+		l.Error("[Running Gin] encountered an error on startup", zap.Error(err))
+		return err
+	}
 
-	a.state.GinInitialized = true
+	a.state.set(func(s *AppState) { s.GinInitialized = true })
 	return nil
 }
 
 func (a *app) _run_http(ctx *AppContext) error {
 	l := a.l
-	err := a._start_http_server(ctx, a.features.HTTP.Mux, a.features.HTTP.Port, "http")
+	err := a._start_http_server(ctx, a._wrap_http(a.features.HTTP.Mux), a.features.HTTP.Port, HTTPFeatureName)
 	if err != nil {
 		l.Error("[Running HTTP] encountered an error on startup", zap.Error(err))
 		return err
 	}
 
-	a.state.HTTPInitialized = true
+	a.state.set(func(s *AppState) { s.HTTPInitialized = true })
 	return nil
 }
 
 func (a *app) _run(ctx *AppContext) error {
 	l := a.l
+	a._wrap_client()
+	ctx.httpClient = a.httpClient
 
-	if a.features.Gin.Enabled {
-		err := a._run_gin(ctx)
-		if err != nil {
-			a.l.Error("[Running Gin] encountered an error when running gin", zap.Error(err))
-			return err
+	for _, f := range a._started_features() {
+		bf, ok := f.(*builtinFeature)
+		if !ok || bf.run == nil {
+			continue
 		}
-	}
 
-	if a.features.HTTP.Enabled {
-		err := a._run_http(ctx)
+		err := bf.run(ctx)
 		if err != nil {
-			a.l.Error("[Running HTTP] encountered an error when running http", zap.Error(err))
+			l.Error("[Running] encountered an error when running feature", zap.Error(err), zap.String("feature", f.Name()))
 			return err
 		}
 	}
-	a.state.Running = true
-	a.state.Healthy = true
+	a._refresh_health(ctx)
+	a.state.transition(PhaseRunning)
 
-	a.threadWg.Add(1)
-	go func() {
-		defer a.threadWg.Done()
-		<-ctx.Done()
-		for _, f := range a.stopServers {
-			server, err := f()
-			if err != nil {
-				l.Error("[Startup] encountered an error when stopping server", zap.Error(err), zap.String("server", server))
-			}
+	return nil
+}
 
-			l.Info("[Startup] stopped server", zap.String("server", server))
-		}
-	}()
+// _abort_startup stops the features that were already started after a
+// startup error and marks the app as failed.
+func (a *app) _abort_startup(err error) error {
+	a._end_startup_span(err)
+	a.state.transition(PhaseDraining)
+	err = errors.Join(err, a._stop_features())
+	a.state.transition(PhaseFailed)
 
-	return nil
+	return err
 }
 
-func (a *app) _startup(ctx context.Context) error {
+func (a *app) _startup(ctx context.Context) (err error) {
 	l := a.l
 	if a.onPanic != nil {
 		defer func() {
-			if err := recover(); err != nil {
-				l.Warn("recovered from panic", zap.Any("error", err))
-				a.onPanic(err)
+			if r := recover(); r != nil {
+				a._handle_panic(l, "[Startup] recovered from panic", r)
+				err = a._abort_startup(fmt.Errorf("recovered from panic: %v", r))
 			}
 		}()
 	}
 
-	startup_funcs := []func(ctx *AppContext) error{}
-
-	if a.features.Registry.enabled {
-		l.Info("[Startup] registry enabled")
-		startup_funcs = append(startup_funcs, a._startup_registry)
-	}
-
-	if a.features.JWT.Enabled {
-		l.Info("[Startup] JWT enabled")
-		startup_funcs = append(startup_funcs, a._startup_jwt)
+	if !a.state.transition(PhaseStarting) {
+		return fmt.Errorf("app can not be started in phase %s", a.state.phase())
 	}
 
-	if a.features.RSA.Enabled {
-		l.Info("[Startup] RSA enabled")
-		startup_funcs = append(startup_funcs, a._startup_rsa)
-	}
-
-	if a.features.SQL.Enabled {
-		l.Info("[Startup] SQL enabled")
-		startup_funcs = append(startup_funcs, a._startup_sql)
-	}
-
-	if a.features.Docs.Enabled {
-		l.Info("[Startup] Docs enabled")
-		startup_funcs = append(startup_funcs, a._startup_docs)
-	}
-
-	if a.features.LoggingAPI.Enabled {
-		l.Info("[Startup] Logging API enabled")
-		startup_funcs = append(startup_funcs, a._startup_logging_api)
-	}
-
-	if a.features.TLS.Enabled {
-		l.Info("[Startup] TLS enabled")
-		startup_funcs = append(startup_funcs, a._startup_tls)
-	}
-
-	if a.features.Health.Enabled {
-		l.Info("[Startup] Health enabled")
-		startup_funcs = append(startup_funcs, a._startup_health)
+	features, err := a._ordered_features()
+	if err != nil {
+		l.Error("[Startup] invalid features", zap.Error(err))
+		a.state.transition(PhaseFailed)
+		return err
 	}
 
 	appCtx := NewAppContext(ctx, a.l)
-	for _, f := range startup_funcs {
-		err := f(appCtx)
+	a._set_app_ctx(appCtx)
+	for _, f := range features {
+		l.Debug("[Startup] starting feature", zap.String("feature", f.Name()))
+		a.state.setFeature(f.Name(), FeatureStarting)
+		err := f.Start(appCtx)
 		if err != nil {
-			return err
+			l.Error("[Startup] encountered an error when starting feature", zap.Error(err), zap.String("feature", f.Name()))
+			a.state.setFeature(f.Name(), FeatureFailed)
+			return a._abort_startup(err)
 		}
+		a.state.setFeature(f.Name(), FeatureStarted)
+		appCtx.Span().AddEvent("feature started", trace.WithAttributes(attribute.String("feature", f.Name())))
+		a.startedM.Lock()
+		a.started = append(a.started, f)
+		a.startedM.Unlock()
+		a._add_feature_check(f)
 	}
 
 	if a.setup != nil {
@@ -538,20 +473,27 @@ func (a *app) _startup(ctx context.Context) error {
 		err := a.setup(appCtx)
 		if err != nil {
 			l.Error("[Startup] encountered an error on setup", zap.Error(err))
-			return err
+			return a._abort_startup(err)
 		}
 	}
 
-	err := a._run(appCtx)
+	a._detach_startup_span(appCtx)
+	err = a._run(appCtx)
 	if err != nil {
 		l.Error("[Startup] encountered an error when running app", zap.Error(err))
-		return err
+		return a._abort_startup(err)
 	}
+	a._end_startup_span(nil)
 
 	if a.running != nil {
 		a.threadWg.Add(1)
 		go func() {
 			defer a.threadWg.Done()
+			defer func() {
+				if err := recover(); err != nil {
+					a._handle_panic(l, "[Running] recovered from panic in running hook", err)
+				}
+			}()
 			l.Debug("[Startup] Running app...")
 			err := a.running(appCtx)
 			if err != nil {
@@ -560,16 +502,31 @@ func (a *app) _startup(ctx context.Context) error {
 		}()
 	}
 
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		l.Info("[Stopping] context done, shutting down")
+	case serveErr = <-a.serveErrs:
+		l.Error("[Stopping] a server exited unexpectedly, shutting down", zap.Error(serveErr))
+	}
+
+	a.state.transition(PhaseDraining)
+	stopErr := errors.Join(serveErr, a._stop_features())
 	a.threadWg.Wait()
 	l.Debug("[Startup] app stopped")
-	a.state.Running = false
 	if a.stopped != nil {
 		err := a.stopped(appCtx)
 		if err != nil {
 			l.Error("[Startup] encountered an error on stopping", zap.Error(err))
-			return err
+			stopErr = errors.Join(stopErr, err)
 		}
 	}
 
+	if stopErr != nil {
+		a.state.transition(PhaseFailed)
+		return stopErr
+	}
+
+	a.state.transition(PhaseStopped)
 	return nil
 }
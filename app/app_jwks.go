@@ -0,0 +1,421 @@
+package app
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwtv5 "github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+const DefaultJWKSPath = "/.well-known/jwks.json"
+
+const (
+	defaultJWKSRefreshInterval = 5 * time.Minute
+	// jwksMinRefreshInterval is how often a remote JWKS is fetched at most
+	// because of a token with an unknown kid.
+	jwksMinRefreshInterval = 10 * time.Second
+	jwksFetchTimeout       = 10 * time.Second
+	maxJWKSSize            = 1 << 20
+)
+
+// errJWKSNotDue is returned by a fetch of a remote JWKS that was tried recently.
+var errJWKSNotDue = errors.New("the jwks was fetched recently")
+
+// JWK is a public RSA key of a JWKS, RFC 7517.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS is the set of public keys served by the JWT feature.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func newRSAJWK(kid string, pub *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: jwtv5.SigningMethodRS256.Name,
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+// rsaPublicKey returns the key of k, it fails for keys that are not RSA.
+func (k JWK) rsaPublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %v", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %v", err)
+	}
+
+	exp := new(big.Int).SetBytes(e)
+	if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("invalid exponent")
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+}
+
+// jwkThumbprint returns the RFC 7638 thumbprint of pub, it is the kid of the
+// keys of the JWT feature.
+func jwkThumbprint(pub *rsa.PublicKey) string {
+	k := newRSAJWK("", pub)
+	sum := sha256.Sum256([]byte(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, k.E, k.N)))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// jwtKey is a key of the JWT feature, priv is nil for keys that only verify.
+type jwtKey struct {
+	kid  string
+	priv *rsa.PrivateKey
+	pub  *rsa.PublicKey
+	// created is when the key was generated or written, rotation replaces
+	// the signing key once it is older than the rotation interval.
+	created time.Time
+	// path is the file the key was read from or written to.
+	path string
+}
+
+func newJWTKey(priv *rsa.PrivateKey) *jwtKey {
+	return &jwtKey{kid: jwkThumbprint(&priv.PublicKey), priv: priv, pub: &priv.PublicKey, created: time.Now()}
+}
+
+// RemoteJWKS is the JWKS of another service. Its keys only verify tokens of
+// Issuers, so the service can not issue tokens of the app.
+type RemoteJWKS struct {
+	URL     string   `yaml:"url"`
+	Issuers []string `yaml:"issuers"`
+}
+
+// remoteKeySet holds the keys of a remote JWKS.
+type remoteKeySet struct {
+	url     string
+	issuers []string
+	// fetches shares a fetch that is in progress between its callers.
+	fetches singleflight.Group
+
+	m       sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+	tried   time.Time
+	err     error
+}
+
+// fetch replaces the keys with the ones served at the url, the current keys
+// are kept when the JWKS can not be fetched. With due it only fetches when
+// the JWKS was not tried recently. Callers share the fetch in progress.
+func (r *remoteKeySet) fetch(ctx context.Context, client *http.Client, due bool) error {
+	_, err, _ := r.fetches.Do(r.url, func() (interface{}, error) {
+		r.m.Lock()
+		if due && time.Since(r.tried) < jwksMinRefreshInterval {
+			r.m.Unlock()
+			return nil, errJWKSNotDue
+		}
+		r.tried = time.Now()
+		r.m.Unlock()
+
+		// the fetch is shared, a caller that gives up does not cancel it
+		keys, err := fetchJWKS(context.WithoutCancel(ctx), client, r.url)
+
+		r.m.Lock()
+		defer r.m.Unlock()
+		r.err = err
+		if err != nil {
+			return nil, err
+		}
+		r.keys = keys
+		r.fetched = time.Now()
+
+		return nil, nil
+	})
+
+	return err
+}
+
+func fetchJWKS(ctx context.Context, client *http.Client, url string) (map[string]*rsa.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch jwks %s: status %d", url, resp.StatusCode)
+	}
+
+	var set JWKS
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode jwks %s: %v", url, err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kid == "" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		pub, err := k.rsaPublicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	return keys, nil
+}
+
+// key returns the key with kid.
+func (r *remoteKeySet) key(kid string) (*rsa.PublicKey, bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	pub, ok := r.keys[kid]
+	return pub, ok
+}
+
+// trusts reports whether the keys verify tokens of issuer.
+func (r *remoteKeySet) trusts(issuer string) bool {
+	return slices.Contains(r.issuers, issuer)
+}
+
+// jwtKeys holds the key tokens are signed with and the keys they are
+// verified with: the previous signing keys, the configured verification keys
+// and the keys of the remote JWKS.
+type jwtKeys struct {
+	m sync.RWMutex
+	// signing is the current signing key.
+	signing *jwtKey
+	// previous are the former signing keys, the newest first.
+	previous []*jwtKey
+	// static are the configured verification keys, they are never rotated.
+	static []*jwtKey
+	remote []*remoteKeySet
+}
+
+func newJWTKeys(signing *jwtKey, previous, static []*jwtKey, remote []RemoteJWKS) *jwtKeys {
+	k := &jwtKeys{signing: signing, previous: previous, static: static}
+	for _, r := range remote {
+		k.remote = append(k.remote, &remoteKeySet{url: r.URL, issuers: r.Issuers})
+	}
+
+	return k
+}
+
+// current returns the signing key.
+func (k *jwtKeys) current() *jwtKey {
+	k.m.RLock()
+	defer k.m.RUnlock()
+
+	return k.signing
+}
+
+// all returns the signing key followed by the verification keys.
+func (k *jwtKeys) all() []*jwtKey {
+	k.m.RLock()
+	defer k.m.RUnlock()
+
+	all := append([]*jwtKey{k.signing}, k.previous...)
+	return append(all, k.static...)
+}
+
+// set replaces the signing key and the previous keys, only the max newest
+// previous keys are kept. It returns the previous keys that were dropped.
+func (k *jwtKeys) set(signing *jwtKey, previous []*jwtKey, max int) []*jwtKey {
+	k.m.Lock()
+	defer k.m.Unlock()
+
+	var dropped []*jwtKey
+	if len(previous) > max {
+		previous, dropped = previous[:max], previous[max:]
+	}
+	k.signing = signing
+	k.previous = previous
+
+	return dropped
+}
+
+// rotate makes next the signing key, the current one only verifies from now on.
+func (k *jwtKeys) rotate(next *jwtKey, max int) []*jwtKey {
+	k.m.RLock()
+	previous := append([]*jwtKey{k.signing}, k.previous...)
+	k.m.RUnlock()
+
+	return k.set(next, previous, max)
+}
+
+// jwks returns the public keys of the app.
+func (k *jwtKeys) jwks() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range k.all() {
+		set.Keys = append(set.Keys, newRSAJWK(key.kid, key.pub))
+	}
+
+	return set
+}
+
+// local returns the public key of the app with kid, the signing key when
+// kid is empty.
+func (k *jwtKeys) local(kid string) (*rsa.PublicKey, bool) {
+	for _, key := range k.all() {
+		if kid == "" || kid == key.kid {
+			return key.pub, true
+		}
+	}
+
+	return nil, false
+}
+
+// remoteKey returns the key with kid of the remote JWKS trusted for issuer,
+// when no JWKS knows it those that were not fetched recently are fetched
+// again.
+func (k *jwtKeys) remoteKey(ctx context.Context, client *http.Client, issuer, kid string) (*rsa.PublicKey, bool) {
+	for _, r := range k.remote {
+		if !r.trusts(issuer) {
+			continue
+		}
+		if pub, ok := r.key(kid); ok {
+			return pub, true
+		}
+	}
+
+	for _, r := range k.remote {
+		if !r.trusts(issuer) {
+			continue
+		}
+		if err := r.fetch(ctx, client, true); err != nil {
+			continue
+		}
+		if pub, ok := r.key(kid); ok {
+			return pub, true
+		}
+	}
+
+	return nil, false
+}
+
+// refresh fetches every remote JWKS.
+func (k *jwtKeys) refresh(ctx context.Context, client *http.Client, l *zap.Logger) {
+	for _, r := range k.remote {
+		if err := r.fetch(ctx, client, false); err != nil {
+			l.Warn("[JWT] failed to refresh remote jwks, keeping its keys", zap.String("url", r.url), zap.Error(err))
+		}
+	}
+}
+
+// health returns an error for the remote JWKS that were never fetched.
+func (k *jwtKeys) health() error {
+	for _, r := range k.remote {
+		r.m.Lock()
+		fetched, err := r.fetched, r.err
+		r.m.Unlock()
+		if fetched.IsZero() {
+			return fmt.Errorf("remote jwks %s was not fetched: %v", r.url, err)
+		}
+	}
+
+	return nil
+}
+
+func (a *app) _handle_jwks(ctx *AppContext, path string) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		_ = json.NewEncoder(w).Encode(ctx.jwtKeys.jwks())
+	}
+
+	if a.features.Gin.Enabled {
+		a.features.Gin.Engine.GET(path, gin.WrapF(handler))
+	}
+
+	if a.features.HTTP.Enabled {
+		a.features.HTTP.Mux.HandleFunc(http.MethodGet+" "+path, handler)
+	}
+}
+
+// _run_jwt rotates the signing key when a rotation interval is set, and
+// fetches the remote JWKS and refreshes them in the background on every
+// refresh interval.
+func (a *app) _run_jwt(ctx *AppContext) error {
+	keys := ctx.jwtKeys
+	if keys == nil {
+		return nil
+	}
+
+	if a.features.JWT.RotationInterval > 0 {
+		a._run_jwt_rotation(ctx)
+	}
+
+	if len(keys.remote) == 0 {
+		return nil
+	}
+
+	interval := a.features.JWT.JWKSRefreshInterval
+	if interval <= 0 {
+		interval = defaultJWKSRefreshInterval
+	}
+
+	for _, r := range a.features.JWT.RemoteJWKS {
+		a.l.Info("[Running JWT] verifying tokens with remote jwks", zap.String("url", r.URL), zap.Strings("issuers", r.Issuers))
+	}
+	keys.refresh(ctx, ctx.HTTPClient(), a.l)
+	a.threadWg.Add(1)
+	go func() {
+		defer a.threadWg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				keys.refresh(ctx, ctx.HTTPClient(), a.l)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (a *app) _health_jwt(ctx context.Context) error {
+	appCtx := a._app_ctx()
+	if appCtx == nil || appCtx.jwtKeys == nil {
+		return nil
+	}
+
+	return appCtx.jwtKeys.health()
+}
@@ -0,0 +1,309 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jwtv5 "github.com/golang-jwt/jwt/v5"
+	"github.com/ooqls/go-crypto/jwt"
+	"github.com/ooqls/go-crypto/keys"
+	"go.uber.org/zap"
+)
+
+// JWTClaimsKey is the key of the claims in the keys of a *gin.Context.
+const JWTClaimsKey = "jwt_claims"
+
+const (
+	jwtAuth_audienceOpt  string = "opt-jwt-auth-audience"
+	jwtAuth_authorizeOpt string = "opt-jwt-auth-authorize"
+	jwtAuth_leewayOpt    string = "opt-jwt-auth-leeway"
+)
+
+type jwtAuthOpt struct {
+	featureOpt
+}
+
+// WithJWTAudience accepts tokens for one of aud instead of the audience of the
+// token configuration.
+func WithJWTAudience(aud ...string) jwtAuthOpt {
+	return jwtAuthOpt{
+		featureOpt: featureOpt{
+			key:   jwtAuth_audienceOpt,
+			value: aud,
+		},
+	}
+}
+
+// WithJWTAuthorize calls f with the claims of every verified token, the
+// request is answered with 403 when f returns an error.
+func WithJWTAuthorize(f func(r *http.Request, claims *JWTClaims) error) jwtAuthOpt {
+	return jwtAuthOpt{
+		featureOpt: featureOpt{
+			key:   jwtAuth_authorizeOpt,
+			value: f,
+		},
+	}
+}
+
+// WithJWTLeeway allows for clock skew when the expiry and the not before time
+// of a token are checked.
+func WithJWTLeeway(d time.Duration) jwtAuthOpt {
+	return jwtAuthOpt{
+		featureOpt: featureOpt{
+			key:   jwtAuth_leewayOpt,
+			value: d,
+		},
+	}
+}
+
+type jwtAuth struct {
+	audience  []string
+	authorize func(r *http.Request, claims *JWTClaims) error
+	leeway    time.Duration
+}
+
+func newJWTAuth(opts []jwtAuthOpt) jwtAuth {
+	o := jwtAuth{}
+	for _, opt := range opts {
+		switch opt.key {
+		case jwtAuth_audienceOpt:
+			o.audience = opt.value.([]string)
+		case jwtAuth_authorizeOpt:
+			o.authorize = opt.value.(func(r *http.Request, claims *JWTClaims) error)
+		case jwtAuth_leewayOpt:
+			o.leeway = opt.value.(time.Duration)
+		}
+	}
+
+	return o
+}
+
+// JWTClaims are the claims of a verified token, CustomClaims holds the raw
+// custom claims of tokens issued with go-crypto's jwt package.
+type JWTClaims struct {
+	jwtv5.RegisteredClaims
+	CustomClaims json.RawMessage `json:"custom_claims,omitempty"`
+}
+
+type jwtClaimsKey struct{}
+
+// WithJWTClaims returns a copy of ctx that carries claims.
+func WithJWTClaims(ctx context.Context, claims *JWTClaims) context.Context {
+	return context.WithValue(ctx, jwtClaimsKey{}, claims)
+}
+
+// JWTClaimsFromContext returns the claims of the token verified by RequireJWT,
+// ctx can be the context of a request or a *gin.Context.
+func JWTClaimsFromContext(ctx context.Context) (*JWTClaims, bool) {
+	if c, ok := ctx.(*gin.Context); ok && c.Request != nil {
+		ctx = c.Request.Context()
+	}
+
+	claims, ok := ctx.Value(jwtClaimsKey{}).(*JWTClaims)
+	return claims, ok
+}
+
+// CustomClaimsFromContext decodes the custom claims of the token verified by
+// RequireJWT into C.
+func CustomClaimsFromContext[C any](ctx context.Context) (C, error) {
+	var custom C
+	claims, ok := JWTClaimsFromContext(ctx)
+	if !ok {
+		return custom, fmt.Errorf("no verified token in context")
+	}
+
+	if len(claims.CustomClaims) == 0 {
+		return custom, nil
+	}
+
+	if err := json.Unmarshal(claims.CustomClaims, &custom); err != nil {
+		return custom, fmt.Errorf("failed to decode custom claims: %v", err)
+	}
+
+	return custom, nil
+}
+
+// bearerToken returns the token of the Authorization header of r.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// jwtKey returns the keyfunc of tokens of issuer. It returns the key of the
+// app with the kid of the token, or the key with the kid of a remote JWKS
+// that is trusted for issuer. Tokens without a kid are verified with the
+// signing key.
+func (ctx *AppContext) jwtKey(issuer string) jwtv5.Keyfunc {
+	return func(t *jwtv5.Token) (interface{}, error) {
+		if ctx.jwtKeys == nil {
+			return keys.JWT().PublicKey(), nil
+		}
+
+		kid, _ := t.Header["kid"].(string)
+		if pub, ok := ctx.jwtKeys.local(kid); ok {
+			return pub, nil
+		}
+
+		if pub, ok := ctx.jwtKeys.remoteKey(ctx, ctx.HTTPClient(), issuer, kid); ok {
+			return pub, nil
+		}
+
+		return nil, fmt.Errorf("unknown key id %s", kid)
+	}
+}
+
+// signJWT signs claims with the signing key, its kid is set in the header.
+func (ctx *AppContext) signJWT(claims jwtv5.Claims) (string, error) {
+	if ctx.jwtKeys == nil {
+		token, _, err := keys.JWT().Sign(claims)
+		return token, err
+	}
+
+	key := ctx.jwtKeys.current()
+	token := jwtv5.NewWithClaims(jwtv5.SigningMethodRS256, claims)
+	token.Header["kid"] = key.kid
+	signed, err := token.SignedString(key.priv)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign claims: %v", err)
+	}
+
+	return signed, nil
+}
+
+// errJWTAudience is returned by parseJWT for a token of another audience.
+var errJWTAudience = errors.New("the token is not meant for this audience")
+
+// parseJWT returns the claims of token when it is signed with the JWT key,
+// issued by the issuer of cfg for one of audience and not expired. The
+// audience of cfg is used when audience is nil.
+func (ctx *AppContext) parseJWT(token string, cfg *jwt.TokenConfiguration, audience []string, leeway time.Duration) (*JWTClaims, error) {
+	claims := &JWTClaims{}
+	parser := jwtv5.NewParser(
+		jwtv5.WithValidMethods([]string{jwtv5.SigningMethodRS256.Name}),
+		jwtv5.WithIssuer(cfg.Issuer),
+		jwtv5.WithExpirationRequired(),
+		jwtv5.WithLeeway(leeway),
+	)
+	if _, err := parser.ParseWithClaims(token, claims, ctx.jwtKey(cfg.Issuer)); err != nil {
+		return nil, err
+	}
+
+	if audience == nil {
+		audience = cfg.Audience
+	}
+	if len(audience) > 0 && !slices.ContainsFunc(claims.Audience, func(aud string) bool {
+		return slices.Contains(audience, aud)
+	}) {
+		return nil, errJWTAudience
+	}
+
+	return claims, nil
+}
+
+// verifyJWT returns the claims of the bearer token of r, or the problem the
+// request is answered with.
+func (ctx *AppContext) verifyJWT(r *http.Request, issuer string, o jwtAuth) (*JWTClaims, *Problem) {
+	l := loggerFromContext(r.Context(), ctx.l)
+	cfg, ok := ctx.TokenConfig(issuer)
+	if !ok {
+		l.Error("[JWT] no token configuration for issuer", zap.String("issuer", issuer))
+		p := NewProblem(r, http.StatusInternalServerError, "the server can not verify tokens")
+		return nil, &p
+	}
+
+	token, ok := bearerToken(r)
+	if !ok {
+		p := NewProblem(r, http.StatusUnauthorized, "a bearer token is required")
+		return nil, &p
+	}
+
+	claims, err := ctx.parseJWT(token, cfg, o.audience, o.leeway)
+	if errors.Is(err, errJWTAudience) {
+		p := NewProblem(r, http.StatusForbidden, err.Error())
+		return nil, &p
+	}
+	if err != nil {
+		l.Debug("[JWT] rejected token", zap.String("issuer", issuer), zap.Error(err))
+		p := NewProblem(r, http.StatusUnauthorized, jwtErrorDetail(err, issuer))
+		return nil, &p
+	}
+
+	if o.authorize != nil {
+		if err := o.authorize(r, claims); err != nil {
+			p := NewProblem(r, http.StatusForbidden, err.Error())
+			return nil, &p
+		}
+	}
+
+	return claims, nil
+}
+
+// jwtErrorDetail returns the detail of the problem of a rejected token.
+func jwtErrorDetail(err error, issuer string) string {
+	switch {
+	case errors.Is(err, jwtv5.ErrTokenExpired):
+		return "the token is expired"
+	case errors.Is(err, jwtv5.ErrTokenInvalidIssuer):
+		return fmt.Sprintf("the token was not issued by %s", issuer)
+	default:
+		return "the token is invalid"
+	}
+}
+
+// writeAuthProblem writes p, a 401 tells the client to authenticate with a
+// bearer token.
+func writeAuthProblem(w http.ResponseWriter, p Problem) {
+	if p.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+
+	WriteProblem(w, p)
+}
+
+// RequireJWT returns a gin middleware that only lets requests with a valid
+// bearer token of issuer pass, the claims are put in the request context and
+// under JWTClaimsKey. Missing or invalid tokens are answered with 401, tokens
+// for another audience or rejected by WithJWTAuthorize with 403. The token
+// configuration of issuer is looked up on every request, so it follows
+// config reloads.
+func (ctx *AppContext) RequireJWT(issuer string, opts ...jwtAuthOpt) gin.HandlerFunc {
+	o := newJWTAuth(opts)
+	return func(c *gin.Context) {
+		claims, p := ctx.verifyJWT(c.Request, issuer, o)
+		if p != nil {
+			writeAuthProblem(c.Writer, *p)
+			c.Abort()
+			return
+		}
+
+		c.Request = c.Request.WithContext(WithJWTClaims(c.Request.Context(), claims))
+		c.Set(JWTClaimsKey, claims)
+		c.Next()
+	}
+}
+
+// RequireJWTHandler wraps next like RequireJWT for the http mux.
+func (ctx *AppContext) RequireJWTHandler(issuer string, next http.Handler, opts ...jwtAuthOpt) http.Handler {
+	o := newJWTAuth(opts)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, p := ctx.verifyJWT(r, issuer, o)
+		if p != nil {
+			writeAuthProblem(w, *p)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithJWTClaims(r.Context(), claims)))
+	})
+}
@@ -0,0 +1,353 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ooqls/go-crypto/keys"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxPreviousJWTKeys = 2
+	// noPreviousJWTKeys is the JWTFeature.MaxPreviousKeys that keeps no
+	// previous keys, as 0 keeps the default.
+	noPreviousJWTKeys = -1
+	jwtKeyBits        = 2048
+)
+
+// maxPreviousJWTKeys returns the JWTFeature.MaxPreviousKeys that keeps n
+// previous keys.
+func maxPreviousJWTKeys(n int) int {
+	if n == 0 {
+		return noPreviousJWTKeys
+	}
+
+	return n
+}
+
+// parseJWTKey returns the key of the pem block of b, an RSA private key in
+// PKCS1 or PKCS8 form or an RSA public key that only verifies.
+func parseJWTKey(b []byte) (*jwtKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported pem block %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return newJWTKey(k), nil
+	case *rsa.PublicKey:
+		return &jwtKey{kid: jwkThumbprint(k), pub: k, created: time.Now()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, expected RSA", key)
+	}
+}
+
+// readJWTKey reads the key of the file at path, it was created when the file
+// was last modified.
+func readJWTKey(path string) (*jwtKey, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("JWT key %s does not exist: %v", path, err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT key %s: %v", path, err)
+	}
+
+	k, err := parseJWTKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JWT key %s: %v", path, err)
+	}
+	k.created = info.ModTime()
+	k.path = path
+
+	return k, nil
+}
+
+func generateJWTKey() (*jwtKey, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, jwtKeyBits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate JWT key: %v", err)
+	}
+
+	return newJWTKey(priv), nil
+}
+
+// pem returns the pem encoded private and public key of k.
+func (k *jwtKey) pem() (priv, pub []byte) {
+	priv = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k.priv)})
+	pub = pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(k.pub)})
+	return priv, pub
+}
+
+// write writes the private key of k to a new file of dir, only the owner can
+// read it.
+func (k *jwtKey) write(dir string) error {
+	priv, _ := k.pem()
+	path := filepath.Join(dir, fmt.Sprintf("jwt-%d.pem", k.created.UnixNano()))
+	if err := os.WriteFile(path, priv, 0600); err != nil {
+		return fmt.Errorf("failed to write JWT key %s: %v", path, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	k.path = path
+	k.created = info.ModTime()
+
+	return nil
+}
+
+// readJWTKeyDir reads the .pem files of dir. The newest private key is the
+// signing key, the other keys only verify, the newest first. The signing key
+// is nil when dir holds no private key.
+func readJWTKeyDir(dir string) (signing *jwtKey, previous []*jwtKey, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read JWT key dir %s: %v", dir, err)
+	}
+
+	all := []*jwtKey{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".pem") {
+			continue
+		}
+
+		k, err := readJWTKey(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, nil, err
+		}
+		all = append(all, k)
+	}
+
+	sort.SliceStable(all, func(i, j int) bool { return all[i].created.After(all[j].created) })
+	for _, k := range all {
+		if signing == nil && k.priv != nil {
+			signing = k
+			continue
+		}
+		previous = append(previous, k)
+	}
+
+	return signing, previous, nil
+}
+
+// _load_jwt_keys returns the signing key, the previous keys and the
+// configured verification keys of the JWT feature. Keys that are configured
+// but missing fail the startup, a key is only generated when none are
+// configured or the key dir is empty.
+func (a *app) _load_jwt_keys(l *zap.Logger) (signing *jwtKey, previous, static []*jwtKey, err error) {
+	f := a.features.JWT
+	switch {
+	case f.KeyDir != "" && (f.PrivateKeyPath != "" || f.PubKeyPath != ""):
+		return nil, nil, nil, fmt.Errorf("a JWT key dir can not be used together with a private and public key path")
+	case f.PrivateKeyPath != "" || f.PubKeyPath != "":
+		if f.PrivateKeyPath == "" || f.PubKeyPath == "" {
+			return nil, nil, nil, fmt.Errorf("the JWT private and public key path have to be set together")
+		}
+		l.Debug("[Startup JWT] initializing JWT keys with paths",
+			zap.String("jwt_private_key_path", f.PrivateKeyPath),
+			zap.String("jwt_pub_key_path", f.PubKeyPath),
+		)
+		if signing, err = readJWTKey(f.PrivateKeyPath); err != nil {
+			return nil, nil, nil, err
+		}
+		if signing.priv == nil {
+			return nil, nil, nil, fmt.Errorf("JWT private key %s holds no private key", f.PrivateKeyPath)
+		}
+		pub, err := readJWTKey(f.PubKeyPath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !pub.pub.Equal(signing.pub) {
+			return nil, nil, nil, fmt.Errorf("JWT public key %s does not belong to the private key %s", f.PubKeyPath, f.PrivateKeyPath)
+		}
+	case f.KeyDir != "":
+		if signing, previous, err = a._read_jwt_key_dir(l); err != nil {
+			return nil, nil, nil, err
+		}
+	default:
+		l.Warn("[Startup JWT] no JWT keys configured, generating a key, tokens do not survive a restart")
+		if signing, err = generateJWTKey(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	for _, path := range f.PreviousKeyPaths {
+		k, err := readJWTKey(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		static = append(static, k)
+	}
+
+	return signing, previous, static, nil
+}
+
+// _read_jwt_key_dir reads the keys of the key dir, a key is generated and
+// written to it when it holds none.
+func (a *app) _read_jwt_key_dir(l *zap.Logger) (*jwtKey, []*jwtKey, error) {
+	dir := a.features.JWT.KeyDir
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return nil, nil, fmt.Errorf("JWT key dir %s does not exist", dir)
+	}
+
+	signing, previous, err := readJWTKeyDir(dir)
+	if err != nil || signing != nil {
+		return signing, previous, err
+	}
+
+	l.Info("[Startup JWT] no JWT key found, generating a key", zap.String("dir", dir))
+	signing, err = generateJWTKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return signing, previous, signing.write(dir)
+}
+
+// _max_previous_jwt_keys returns how many previous signing keys are kept.
+func (a *app) _max_previous_jwt_keys() int {
+	if a.features.JWT.MaxPreviousKeys == 0 {
+		return defaultMaxPreviousJWTKeys
+	}
+
+	return max(a.features.JWT.MaxPreviousKeys, 0)
+}
+
+// _use_jwt_key makes k the key of go-crypto's keys.JWT, for code that signs
+// or verifies with it directly.
+func (a *app) _use_jwt_key(k *jwtKey) error {
+	priv, pub := k.pem()
+	rsaKey, err := keys.ParseRSA(priv, pub)
+	if err != nil {
+		return err
+	}
+
+	keys.SetJwt(keys.NewJWTKey(*rsaKey))
+	return nil
+}
+
+// _reload_jwt_keys reads the key dir again, e.g. after another instance
+// rotated the key. It returns the keys dropped for exceeding the max previous
+// keys.
+func (a *app) _reload_jwt_keys(ctx *AppContext) ([]*jwtKey, error) {
+	if a.features.JWT.KeyDir == "" || ctx.jwtKeys == nil {
+		return nil, nil
+	}
+
+	signing, previous, err := a._read_jwt_key_dir(a.l)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reload JWT keys: %v", err)
+	}
+
+	current := ctx.jwtKeys.current()
+	dropped := ctx.jwtKeys.set(signing, previous, a._max_previous_jwt_keys())
+	if signing.kid != current.kid {
+		a.l.Info("[JWT] using signing key", zap.String("kid", signing.kid))
+		return dropped, a._use_jwt_key(signing)
+	}
+
+	return dropped, nil
+}
+
+// _reload_jwt picks up the keys another instance wrote to the key dir.
+func (a *app) _reload_jwt(ctx *AppContext) error {
+	_, err := a._reload_jwt_keys(ctx)
+	return err
+}
+
+// _rotate_jwt_key replaces the signing key once it is older than the
+// rotation interval. The replaced key keeps verifying tokens until it is
+// dropped for a newer one, with a key dir its file is removed then.
+func (a *app) _rotate_jwt_key(ctx *AppContext) error {
+	f := a.features.JWT
+	dropped, err := a._reload_jwt_keys(ctx)
+	if err != nil {
+		return err
+	}
+
+	if time.Since(ctx.jwtKeys.current().created) >= f.RotationInterval {
+		next, err := generateJWTKey()
+		if err != nil {
+			return err
+		}
+		if f.KeyDir != "" {
+			if err := next.write(f.KeyDir); err != nil {
+				return err
+			}
+		}
+
+		dropped = append(dropped, ctx.jwtKeys.rotate(next, a._max_previous_jwt_keys())...)
+		a.l.Info("[JWT] rotated signing key", zap.String("kid", next.kid))
+		if err := a._use_jwt_key(next); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range dropped {
+		if f.KeyDir == "" || k.path == "" || filepath.Dir(k.path) != filepath.Clean(f.KeyDir) {
+			continue
+		}
+		a.l.Info("[JWT] removing dropped key", zap.String("kid", k.kid), zap.String("path", k.path))
+		if err := os.Remove(k.path); err != nil && !os.IsNotExist(err) {
+			a.l.Warn("[JWT] failed to remove dropped key", zap.String("path", k.path), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// _run_jwt_rotation rotates the signing key in the background.
+func (a *app) _run_jwt_rotation(ctx *AppContext) {
+	interval := a.features.JWT.RotationInterval
+	a.l.Info("[Running JWT] rotating the signing key", zap.Duration("interval", interval))
+	a.threadWg.Add(1)
+	go func() {
+		defer a.threadWg.Done()
+		// checking more often than the interval rotates close to it
+		ticker := time.NewTicker(max(interval/10, 10*time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := a._rotate_jwt_key(ctx); err != nil {
+					a.l.Error("[JWT] failed to rotate signing key", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
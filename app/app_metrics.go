@@ -0,0 +1,208 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+var allPhases = []Phase{PhaseCreated, PhaseStarting, PhaseRunning, PhaseDraining, PhaseStopped, PhaseFailed}
+
+type appMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight *prometheus.GaugeVec
+}
+
+func newAppMetrics(reg prometheus.Registerer) (*appMetrics, error) {
+	m := &appMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of handled HTTP requests.",
+		}, []string{"server", "method", "route", "status_class"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Latency of handled HTTP requests.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"server", "method", "route"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Number of HTTP requests currently being served.",
+		}, []string{"server"}),
+	}
+
+	for _, c := range []prometheus.Collector{m.requests, m.duration, m.inFlight} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register http metrics: %v", err)
+		}
+	}
+
+	return m, nil
+}
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func (m *appMetrics) observe(server, method, route string, status int, d time.Duration) {
+	m.requests.WithLabelValues(server, method, route, statusClass(status)).Inc()
+	m.duration.WithLabelValues(server, method, route).Observe(d.Seconds())
+}
+
+func (m *appMetrics) ginMiddleware() gin.HandlerFunc {
+	inFlight := m.inFlight.WithLabelValues(GinFeatureName)
+	return func(c *gin.Context) {
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		m.observe(GinFeatureName, c.Request.Method, route, c.Writer.Status(), time.Since(start))
+	}
+}
+
+func (m *appMetrics) httpMiddleware(next http.Handler) http.Handler {
+	inFlight := m.inFlight.WithLabelValues(HTTPFeatureName)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		rec := newResponseRecorder(w)
+		next.ServeHTTP(rec, r)
+		m.observe(HTTPFeatureName, r.Method, routePattern(r), rec.Status(), time.Since(start))
+	})
+}
+
+// stateCollector exports the lifecycle state of the app on every scrape.
+type stateCollector struct {
+	a       *app
+	phase   *prometheus.Desc
+	healthy *prometheus.Desc
+	feature *prometheus.Desc
+	expiry  *prometheus.Desc
+}
+
+func newStateCollector(a *app) *stateCollector {
+	return &stateCollector{
+		a:       a,
+		phase:   prometheus.NewDesc("app_phase", "Current lifecycle phase of the app.", []string{"phase"}, nil),
+		healthy: prometheus.NewDesc("app_healthy", "Whether the app is healthy.", nil, nil),
+		feature: prometheus.NewDesc("app_feature_status", "Current lifecycle status of a feature.", []string{"feature", "status"}, nil),
+		expiry:  prometheus.NewDesc("app_tls_certificate_expiry_timestamp_seconds", "Unix time the server certificate in use expires.", nil, nil),
+	}
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.phase
+	ch <- c.healthy
+	ch <- c.feature
+	ch <- c.expiry
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	state := c.a.State()
+	for _, p := range allPhases {
+		ch <- prometheus.MustNewConstMetric(c.phase, prometheus.GaugeValue, boolValue(state.Phase == p), string(p))
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.healthy, prometheus.GaugeValue, boolValue(state.Healthy))
+	for name, status := range state.Features {
+		ch <- prometheus.MustNewConstMetric(c.feature, prometheus.GaugeValue, 1, name, string(status))
+	}
+
+	if !state.TLSCertificateExpiry.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.expiry, prometheus.GaugeValue, float64(state.TLSCertificateExpiry.Unix()))
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// _startup_metrics instruments the gin engine and the http mux. It starts
+// before the recovery middleware and any route, so every request is counted,
+// including the ones that panic.
+func (a *app) _startup_metrics(ctx *AppContext) error {
+	l := ctx.L()
+	f := &a.features.Metrics
+	if f.Registry == nil {
+		f.Registry = prometheus.NewRegistry()
+	}
+
+	if f.Path == "" {
+		f.Path = DefaultMetricsPath
+	}
+
+	if f.Port == 0 && !a.features.Gin.Enabled && !a.features.HTTP.Enabled {
+		return fmt.Errorf("metrics need a port when neither gin nor http is enabled")
+	}
+
+	m, err := newAppMetrics(f.Registry)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		newStateCollector(a),
+	} {
+		if err := f.Registry.Register(c); err != nil {
+			return fmt.Errorf("failed to register metrics collector: %v", err)
+		}
+	}
+
+	if a.features.Gin.Enabled {
+		l.Debug("[Startup Metrics] instrumenting gin engine")
+		a.features.Gin.Engine.Use(m.ginMiddleware())
+	}
+
+	if a.features.HTTP.Enabled {
+		l.Debug("[Startup Metrics] instrumenting http mux")
+		a._use_http(m.httpMiddleware)
+	}
+
+	return nil
+}
+
+// _run_metrics serves the metrics, the gin engine and the http mux are
+// complete by then and the metrics route is added behind all their middleware.
+func (a *app) _run_metrics(ctx *AppContext) error {
+	l := ctx.L()
+	f := a.features.Metrics
+	handler := promhttp.HandlerFor(f.Registry, promhttp.HandlerOpts{})
+	if f.Port != 0 {
+		l.Info("[Running Metrics] serving metrics on their own port", zap.Int("port", f.Port), zap.String("path", f.Path))
+		mux := http.NewServeMux()
+		mux.Handle(f.Path, handler)
+		return a._start_http_server(ctx, mux, f.Port, MetricsFeatureName)
+	}
+
+	l.Info("[Running Metrics] serving metrics", zap.String("path", f.Path))
+	if a.features.HTTP.Enabled {
+		a.features.HTTP.Mux.Handle(f.Path, handler)
+	}
+
+	if a.features.Gin.Enabled {
+		a.features.Gin.Engine.GET(f.Path, gin.WrapH(handler))
+	}
+
+	return nil
+}
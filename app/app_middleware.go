@@ -0,0 +1,142 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+)
+
+// httpMiddleware wraps the handler of the http feature.
+type httpMiddleware func(next http.Handler) http.Handler
+
+// _use_http adds a middleware to the handler of the http feature.
+func (a *app) _use_http(mw httpMiddleware) {
+	a.httpMiddleware = append(a.httpMiddleware, mw)
+}
+
+// _wrap_http wraps handler with the middleware of the http feature, the first
+// middleware added is the outermost one.
+func (a *app) _wrap_http(handler http.Handler) http.Handler {
+	for i := len(a.httpMiddleware) - 1; i >= 0; i-- {
+		handler = a.httpMiddleware[i](handler)
+	}
+
+	return handler
+}
+
+// clientMiddleware wraps the transport of the http client of the app.
+type clientMiddleware func(next http.RoundTripper) http.RoundTripper
+
+// _use_client adds a middleware to the transport of the http client of the app.
+func (a *app) _use_client(mw clientMiddleware) {
+	a.clientMiddleware = append(a.clientMiddleware, mw)
+}
+
+// _wrap_client wraps the transport of the http client with the client
+// middleware, the first middleware added is the outermost one. It is called
+// once all features are started, the client is final by then.
+func (a *app) _wrap_client() {
+	if len(a.clientMiddleware) == 0 {
+		return
+	}
+
+	client := *a.httpClient
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	for i := len(a.clientMiddleware) - 1; i >= 0; i-- {
+		transport = a.clientMiddleware[i](transport)
+	}
+	client.Transport = transport
+	a.httpClient = &client
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper.
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// responseRecorder records the status and the size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	if rec, ok := w.(*responseRecorder); ok {
+		return rec
+	}
+
+	return &responseRecorder{ResponseWriter: w}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+
+	return n, err
+}
+
+// Status returns the status of the response, 200 if nothing was written yet.
+func (r *responseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+
+	return r.status
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Flush flushes the wrapped writer, so handlers can stream through the recorder.
+func (r *responseRecorder) Flush() {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	_ = http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Hijack hijacks the connection of the wrapped writer, so handlers can upgrade
+// it to a websocket. The response is recorded as switching protocols.
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+
+	return conn, rw, err
+}
+
+// serveWithContext serves r with ctx as its context. The pattern of the mux
+// route is copied back to r, so outer middleware can see the route.
+func serveWithContext(next http.Handler, w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	rc := r.WithContext(ctx)
+	next.ServeHTTP(w, rc)
+	r.Pattern = rc.Pattern
+}
+
+// routePattern returns the pattern of the mux route that served r.
+func routePattern(r *http.Request) string {
+	if r.Pattern == "" {
+		return "unmatched"
+	}
+
+	return r.Pattern
+}
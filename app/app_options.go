@@ -0,0 +1,99 @@
+package app
+
+import "time"
+
+const (
+	app_stopTimeoutOpt        string = "opt-app-stop-timeout"
+	app_featureStopTimeoutOpt string = "opt-app-feature-stop-timeout"
+	app_signalsOpt            string = "opt-app-signals"
+	app_configReloadOpt       string = "opt-app-config-reload"
+	app_configWatchOpt        string = "opt-app-config-watch-interval"
+)
+
+type appOpt struct {
+	featureOpt
+}
+
+type configReload struct {
+	loader *ConfigLoader
+	config *AppConfig
+}
+
+type featureTimeout struct {
+	feature string
+	timeout time.Duration
+}
+
+// WithStopTimeout sets the time every feature is given to stop, 30 seconds by default.
+func WithStopTimeout(d time.Duration) appOpt {
+	return appOpt{
+		featureOpt: featureOpt{
+			key:   app_stopTimeoutOpt,
+			value: d,
+		},
+	}
+}
+
+// WithFeatureStopTimeout overrides the stop timeout for a single feature.
+func WithFeatureStopTimeout(feature string, d time.Duration) appOpt {
+	return appOpt{
+		featureOpt: featureOpt{
+			key:   app_featureStopTimeoutOpt,
+			value: featureTimeout{feature: feature, timeout: d},
+		},
+	}
+}
+
+// WithSignalHandling makes Run handle OS signals. SIGINT and SIGTERM stop the
+// app gracefully, a second one forces the process to exit and SIGHUP runs the
+// reload hooks.
+func WithSignalHandling() appOpt {
+	return appOpt{
+		featureOpt: featureOpt{
+			key:   app_signalsOpt,
+			value: true,
+		},
+	}
+}
+
+// WithConfigReload reloads the config with loader when its files change or
+// on SIGHUP, cfg is the config the features were built from. The changes to
+// cors, token configurations, the health interval and the log level are
+// applied at runtime, the others are logged as requiring a restart.
+func WithConfigReload(loader *ConfigLoader, cfg *AppConfig) appOpt {
+	return appOpt{
+		featureOpt: featureOpt{
+			key:   app_configReloadOpt,
+			value: configReload{loader: loader, config: cfg},
+		},
+	}
+}
+
+// WithConfigWatchInterval sets how often the config files are checked for
+// changes, 2 seconds by default.
+func WithConfigWatchInterval(d time.Duration) appOpt {
+	return appOpt{
+		featureOpt: featureOpt{
+			key:   app_configWatchOpt,
+			value: d,
+		},
+	}
+}
+
+func (a *app) apply(opt appOpt) {
+	switch opt.key {
+	case app_stopTimeoutOpt:
+		a.stopTimeout = opt.value.(time.Duration)
+	case app_featureStopTimeoutOpt:
+		ft := opt.value.(featureTimeout)
+		a.stopTimeouts[ft.feature] = ft.timeout
+	case app_signalsOpt:
+		a.handleSignals = opt.value.(bool)
+	case app_configReloadOpt:
+		cr := opt.value.(configReload)
+		a.configLoader = cr.loader
+		a.config = cr.config
+	case app_configWatchOpt:
+		a.configWatchInterval = opt.value.(time.Duration)
+	}
+}
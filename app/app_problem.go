@@ -0,0 +1,36 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ProblemContentType is the content type of the error responses of the app.
+const ProblemContentType = "application/problem+json"
+
+// Problem is the body of the error responses of the app, it follows RFC 9457.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// NewProblem returns the problem for status with the request ID of r.
+func NewProblem(r *http.Request, status int, detail string) Problem {
+	return Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		RequestID: RequestIDFromContext(r.Context()),
+	}
+}
+
+// WriteProblem writes p as the response.
+func WriteProblem(w http.ResponseWriter, p Problem) {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
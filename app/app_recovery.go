@@ -0,0 +1,71 @@
+package app
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// _handle_panic logs a recovered panic with its stack and calls the panic hook.
+func (a *app) _handle_panic(l *zap.Logger, msg string, err interface{}) {
+	l.Error(msg, zap.Any("error", err), zap.ByteString("stack", debug.Stack()))
+	if a.onPanic != nil {
+		a.onPanic(err)
+	}
+}
+
+// _recovered handles the panic of a handler, it answers with a 500 problem
+// unless the handler already wrote the response.
+func (a *app) _recovered(w http.ResponseWriter, r *http.Request, err interface{}, written bool) {
+	// the handler aborted the response on purpose, net/http handles it
+	if err == http.ErrAbortHandler {
+		panic(err)
+	}
+
+	a._handle_panic(loggerFromContext(r.Context(), a.l), "recovered from panic in handler", err)
+	if !written {
+		WriteProblem(w, NewProblem(r, http.StatusInternalServerError, "the server encountered an unexpected error"))
+	}
+}
+
+func (a *app) _recovery_gin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if err := recover(); err != nil {
+				a._recovered(c.Writer, c.Request, err, c.Writer.Written())
+				c.Abort()
+			}
+		}()
+		c.Next()
+	}
+}
+
+func (a *app) _recovery_http(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := newResponseRecorder(w)
+		defer func() {
+			if err := recover(); err != nil {
+				a._recovered(rec, r, err, rec.status != 0)
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+func (a *app) _startup_recovery(ctx *AppContext) error {
+	l := a.l
+
+	if a.features.Gin.Enabled {
+		l.Debug("[Startup Recovery] recovering panics of gin handlers")
+		a.features.Gin.Engine.Use(a._recovery_gin())
+	}
+
+	if a.features.HTTP.Enabled {
+		l.Debug("[Startup Recovery] recovering panics of http handlers")
+		a._use_http(a._recovery_http)
+	}
+
+	return nil
+}
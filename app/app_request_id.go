@@ -0,0 +1,124 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// RequestIDHeader is the header that carries the ID of a request.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestIDKey is the key of the request ID in the keys of a *gin.Context.
+const RequestIDKey = "request_id"
+
+// maxRequestIDLength is the length above which an inbound request ID is
+// replaced by a generated one.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx that carries id. Calls made with the
+// http client of the app and ctx forward the ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID of ctx, ctx can be the context
+// of a request, r.Context(), or a *gin.Context. The AppContext of the app is
+// not a request context and carries none.
+func RequestIDFromContext(ctx context.Context) string {
+	if c, ok := ctx.(*gin.Context); ok && c.Request != nil {
+		ctx = c.Request.Context()
+	}
+
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether an inbound request ID can be used as is.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// _request_context reads or generates the ID of r and returns the request
+// context carrying the ID and a request logger with the ID.
+func (a *app) _request_context(r *http.Request) (context.Context, string) {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		id = uuid.NewString()
+	}
+
+	ctx := r.Context()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("http.request_id", id))
+	ctx = WithRequestID(ctx, id)
+	ctx = WithLogger(ctx, loggerFromContext(ctx, a.l).With(zap.String("request_id", id)))
+
+	return ctx, id
+}
+
+func (a *app) _request_id_gin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, id := a._request_context(c.Request)
+		c.Request = c.Request.WithContext(ctx)
+		c.Set(RequestIDKey, id)
+		c.Header(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+func (a *app) _request_id_http(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, id := a._request_context(r)
+		w.Header().Set(RequestIDHeader, id)
+		serveWithContext(next, w, r, ctx)
+	})
+}
+
+// requestIDTransport forwards the request ID of the request context on the
+// calls made with the http client of the app.
+func requestIDTransport(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		id := RequestIDFromContext(r.Context())
+		if id == "" || r.Header.Get(RequestIDHeader) != "" {
+			return next.RoundTrip(r)
+		}
+
+		r = r.Clone(r.Context())
+		r.Header.Set(RequestIDHeader, id)
+		return next.RoundTrip(r)
+	})
+}
+
+func (a *app) _startup_request_id(ctx *AppContext) error {
+	l := a.l
+
+	if a.features.Gin.Enabled {
+		l.Debug("[Startup Request ID] adding request IDs to gin requests")
+		a.features.Gin.Engine.Use(a._request_id_gin())
+	}
+
+	if a.features.HTTP.Enabled {
+		l.Debug("[Startup Request ID] adding request IDs to http requests")
+		a._use_http(a._request_id_http)
+	}
+
+	a._use_client(requestIDTransport)
+
+	return nil
+}
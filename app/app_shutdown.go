@@ -0,0 +1,66 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultStopTimeout = 30 * time.Second
+
+// _stop_timeout returns the time a feature is given to stop.
+func (a *app) _stop_timeout(name string) time.Duration {
+	if d, ok := a.stopTimeouts[name]; ok {
+		return d
+	}
+
+	return a.stopTimeout
+}
+
+// _stop_features stops the started features in reverse start order. Every
+// feature gets its own deadline that does not depend on the root context,
+// which is usually already cancelled when the app is stopping.
+func (a *app) _stop_features() error {
+	l := a.l
+	errs := []error{}
+	// taking the features waits for a reload that is in progress
+	a.startedM.Lock()
+	started := a.started
+	a.started = nil
+	a.startedM.Unlock()
+	for i := len(started) - 1; i >= 0; i-- {
+		f := started[i]
+		timeout := a._stop_timeout(f.Name())
+		l.Debug("[Stopping] stopping feature", zap.String("feature", f.Name()), zap.Duration("timeout", timeout))
+
+		a.state.setFeature(f.Name(), FeatureStopping)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := f.Stop(ctx)
+		cancel()
+		if err != nil {
+			l.Error("[Stopping] encountered an error when stopping feature", zap.Error(err), zap.String("feature", f.Name()))
+			a.state.setFeature(f.Name(), FeatureFailed)
+			errs = append(errs, &FeatureStopError{Feature: f.Name(), Err: err})
+			continue
+		}
+		a.state.setFeature(f.Name(), FeatureStopped)
+		l.Info("[Stopping] stopped feature", zap.String("feature", f.Name()))
+	}
+
+	return errors.Join(errs...)
+}
+
+// _stop_server returns a stop function that drains the named http server.
+func (a *app) _stop_server(name string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		srv, ok := a.servers[name]
+		if !ok {
+			return nil
+		}
+		delete(a.servers, name)
+
+		return srv.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// osExit is replaced in tests.
+var osExit = os.Exit
+
+// _handle_signals returns a context that is cancelled on the first SIGINT or
+// SIGTERM. A second one exits the process, SIGHUP reloads the app.
+func (a *app) _handle_signals(parent context.Context) (context.Context, func()) {
+	l := a.l
+	ctx, cancel := context.WithCancel(parent)
+	sigs := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	go func() {
+		stopping := false
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-sigs:
+				if sig == syscall.SIGHUP {
+					l.Info("[Signals] received SIGHUP, reloading")
+					if err := a._reload(); err != nil {
+						l.Error("[Signals] encountered an error on reload", zap.Error(err))
+					}
+					continue
+				}
+
+				if stopping {
+					l.Warn("[Signals] received a second signal, forcing exit", zap.String("signal", sig.String()))
+					osExit(1)
+					continue
+				}
+
+				l.Info("[Signals] received signal, shutting down", zap.String("signal", sig.String()))
+				stopping = true
+				cancel()
+			}
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigs)
+		close(done)
+		cancel()
+	}
+}
+
+// _reload calls the reload hook and reloads every started feature that
+// implements Reloader. Reloads are dropped once the app is stopping, the
+// features are not stopped while a reload is in progress.
+func (a *app) _reload() error {
+	a.startedM.Lock()
+	defer a.startedM.Unlock()
+
+	switch a.state.phase() {
+	case PhaseDraining, PhaseStopped, PhaseFailed:
+		a.l.Info("[Signals] app is stopping, dropping reload")
+		return nil
+	}
+
+	ctx := a._app_ctx()
+	if ctx == nil {
+		return fmt.Errorf("app is not started")
+	}
+
+	errs := []error{}
+	for _, f := range a.started {
+		r, ok := f.(Reloader)
+		if !ok {
+			continue
+		}
+
+		if err := r.Reload(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to reload feature %s: %v", f.Name(), err))
+		}
+	}
+
+	if a.reload != nil {
+		if err := a.reload(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// _app_ctx returns the context of the running app, nil before it started.
+func (a *app) _app_ctx() *AppContext {
+	a.appCtxM.RLock()
+	defer a.appCtxM.RUnlock()
+
+	return a.appCtx
+}
+
+func (a *app) _set_app_ctx(ctx *AppContext) {
+	a.appCtxM.Lock()
+	defer a.appCtxM.Unlock()
+
+	a.appCtx = ctx
+}
+
+// _started_features returns a copy of the started features.
+func (a *app) _started_features() []Feature {
+	a.startedM.Lock()
+	defer a.startedM.Unlock()
+
+	return append([]Feature{}, a.started...)
+}
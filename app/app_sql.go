@@ -1,11 +1,16 @@
 package app
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"path"
 	"path/filepath"
 
+	pgxv5 "github.com/jackc/pgx/v5"
 	"github.com/jmoiron/sqlx"
 	"github.com/ooqls/go-db/pgx"
+	"github.com/ooqls/go-db/postgres"
 	gosqlx "github.com/ooqls/go-db/sqlx"
 	"go.uber.org/zap"
 )
@@ -63,15 +68,17 @@ func (a *app) _startup_sql(ctx *AppContext) error {
 	if len(sqlFiles) > 0 {
 
 		l.Debug("[Startup SQL] initializing SQL files", zap.Strings("sql_files", sqlFiles))
+		seeded := false
 
 		if a.features.SQL.SQLPackage == SQLXPackage {
-			err := gosqlx.InitDefault()
+			db, err := gosqlx.Init(postgres.GetRegistryOptions())
 			if err != nil {
 				l.Error("[Startup SQL] failed to initialize SQLX", zap.Error(err))
 				return err
 			}
+			a._set_sqlx(db)
 
-			a.state.SQLSeeded = a._seed_sqlx_files(ctx, sqlFiles)
+			seeded = a._seed_sqlx_files(ctx, sqlFiles)
 		} else if a.features.SQL.SQLPackage == PGXPackage {
 			err := pgx.InitDefault()
 			if err != nil {
@@ -79,9 +86,14 @@ func (a *app) _startup_sql(ctx *AppContext) error {
 				return err
 			}
 
-			a.state.SQLSeeded = a._seed_pgx_files(ctx, sqlFiles)
+			seeded = a._seed_pgx_files(ctx, sqlFiles)
+			a._set_pgx(pgx.GetPGX())
 		}
-		l.Debug("[Startup SQL] SQL files initialized successfully")
+		a.state.set(func(s *AppState) { s.SQLSeeded = seeded })
+		if !seeded {
+			a.sqlSeedErr = fmt.Errorf("failed to seed sql files")
+		}
+		l.Debug("[Startup SQL] SQL files initialized")
 	}
 
 	tableStmts := []string{}
@@ -99,8 +111,10 @@ func (a *app) _startup_sql(ctx *AppContext) error {
 		l.Debug("[Startup SQL] seeding with SQL statements")
 		if a.features.SQL.SQLPackage == SQLXPackage {
 			gosqlx.SeedSQLX(tableStmts, indexStmts)
+			a._set_sqlx(gosqlx.GetSQLX())
 		} else if a.features.SQL.SQLPackage == PGXPackage {
 			pgx.SeedPGX(ctx, tableStmts, indexStmts)
+			a._set_pgx(pgx.GetPGX())
 		}
 
 		l.Debug("[Startup SQL] finished seeding with SQL statements")
@@ -108,6 +122,72 @@ func (a *app) _startup_sql(ctx *AppContext) error {
 		l.Debug("[Startup SQL] no SQL statements")
 	}
 
-	a.state.SQLInitialized = true
+	a.state.set(func(s *AppState) { s.SQLInitialized = true })
 	return nil
 }
+
+func (a *app) _set_sqlx(db *sqlx.DB) {
+	a.sqlM.Lock()
+	defer a.sqlM.Unlock()
+
+	a.sqlxDB = db
+}
+
+func (a *app) _set_pgx(conn *pgxv5.Conn) {
+	a.sqlM.Lock()
+	defer a.sqlM.Unlock()
+
+	a.pgxConn = conn
+}
+
+// _health_sql reports the SQL feature as unhealthy when seeding failed or the
+// database does not answer a ping. The connections are not closed while they
+// are pinged.
+func (a *app) _health_sql(ctx context.Context) error {
+	if a.sqlSeedErr != nil {
+		return a.sqlSeedErr
+	}
+
+	a.sqlM.Lock()
+	defer a.sqlM.Unlock()
+
+	if a.sqlxDB != nil {
+		if err := a.sqlxDB.PingContext(ctx); err != nil {
+			return fmt.Errorf("failed to ping SQLX: %v", err)
+		}
+	}
+
+	if a.pgxConn != nil {
+		if err := a.pgxConn.Ping(ctx); err != nil {
+			return fmt.Errorf("failed to ping PGX: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// _stop_sql closes the database connections opened by the SQL feature.
+func (a *app) _stop_sql(ctx context.Context) error {
+	l := a.l
+	a.sqlM.Lock()
+	defer a.sqlM.Unlock()
+
+	errs := []error{}
+	if a.sqlxDB != nil {
+		l.Debug("[Stopping SQL] closing SQLX connection pool")
+		if err := a.sqlxDB.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close SQLX connection pool: %v", err))
+		}
+		a.sqlxDB = nil
+	}
+
+	if a.pgxConn != nil {
+		l.Debug("[Stopping SQL] closing PGX connection")
+		if err := a.pgxConn.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close PGX connection: %v", err))
+		}
+		a.pgxConn = nil
+	}
+
+	return errors.Join(errs...)
+}
@@ -1,16 +1,197 @@
 package app
 
+import (
+	"sync"
+	"time"
+)
+
+// Phase is the lifecycle phase of the app.
+type Phase string
+
+const (
+	PhaseCreated  Phase = "created"
+	PhaseStarting Phase = "starting"
+	PhaseRunning  Phase = "running"
+	PhaseDraining Phase = "draining"
+	PhaseStopped  Phase = "stopped"
+	PhaseFailed   Phase = "failed"
+)
+
+// FeatureStatus is the lifecycle status of a single feature.
+type FeatureStatus string
+
+const (
+	FeatureStarting FeatureStatus = "starting"
+	FeatureStarted  FeatureStatus = "started"
+	FeatureStopping FeatureStatus = "stopping"
+	FeatureStopped  FeatureStatus = "stopped"
+	FeatureFailed   FeatureStatus = "failed"
+)
+
+// phaseTransitions lists the phases that can follow a phase.
+var phaseTransitions = map[Phase][]Phase{
+	PhaseCreated:  {PhaseStarting},
+	PhaseStarting: {PhaseRunning, PhaseDraining, PhaseFailed},
+	PhaseRunning:  {PhaseDraining},
+	PhaseDraining: {PhaseStopped, PhaseFailed},
+}
+
+type LifecycleEventType string
+
+const (
+	PhaseChanged   LifecycleEventType = "phase"
+	FeatureChanged LifecycleEventType = "feature"
+	HealthChanged  LifecycleEventType = "health"
+)
+
+// LifecycleEvent is sent to subscribers on every change of the app phase, the
+// status of a feature or the health status.
+type LifecycleEvent struct {
+	Type          LifecycleEventType
+	Phase         Phase
+	Feature       string
+	FeatureStatus FeatureStatus
+	Health        HealthStatus
+	Time          time.Time
+}
+
+// AppState is a snapshot of the state of the app.
 type AppState struct {
-	RegistryInitialized bool
-	JWTInitialized bool
-	RSAInitialized bool
+	Phase                 Phase
+	Features              map[string]FeatureStatus
+	RegistryInitialized   bool
+	JWTInitialized        bool
+	RSAInitialized        bool
 	LoggingAPIInitialized bool
-	HTTPInitialized bool
-	GinInitialized bool
-	DocsInitialized bool
-	TLSInitialized bool
-	SQLInitialized bool
-	SQLSeeded bool
-	Healthy bool
-	Running bool
-}
\ No newline at end of file
+	HTTPInitialized       bool
+	GinInitialized        bool
+	DocsInitialized       bool
+	TLSInitialized        bool
+	SQLInitialized        bool
+	SQLSeeded             bool
+	Healthy               bool
+	Running               bool
+	// TLSCertificateExpiry is when the server certificate in use expires.
+	TLSCertificateExpiry time.Time
+}
+
+const subscriberBuffer = 64
+
+// appState guards the AppState and publishes its changes to the subscribers.
+type appState struct {
+	m           sync.RWMutex
+	state       AppState
+	subscribers []chan LifecycleEvent
+}
+
+func newAppState() *appState {
+	return &appState{
+		state: AppState{
+			Phase:    PhaseCreated,
+			Features: map[string]FeatureStatus{},
+		},
+	}
+}
+
+// set changes the state with fn.
+func (s *appState) set(fn func(s *AppState)) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	fn(&s.state)
+}
+
+// snapshot returns a copy of the state.
+func (s *appState) snapshot() AppState {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	state := s.state
+	state.Features = make(map[string]FeatureStatus, len(s.state.Features))
+	for name, status := range s.state.Features {
+		state.Features[name] = status
+	}
+
+	return state
+}
+
+func (s *appState) phase() Phase {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return s.state.Phase
+}
+
+// transition moves the app to the next phase, it returns false when the
+// transition is not allowed from the current phase.
+func (s *appState) transition(next Phase) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	allowed := false
+	for _, p := range phaseTransitions[s.state.Phase] {
+		if p == next {
+			allowed = true
+			break
+		}
+	}
+
+	if !allowed {
+		return false
+	}
+
+	s.state.Phase = next
+	s.state.Running = next == PhaseRunning
+	s.publish(LifecycleEvent{Type: PhaseChanged})
+	if next == PhaseStopped || next == PhaseFailed {
+		for _, sub := range s.subscribers {
+			close(sub)
+		}
+		s.subscribers = nil
+	}
+
+	return true
+}
+
+func (s *appState) setFeature(name string, status FeatureStatus) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.state.Features[name] = status
+	s.publish(LifecycleEvent{Type: FeatureChanged, Feature: name, FeatureStatus: status})
+}
+
+func (s *appState) setHealth(status HealthStatus) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.state.Healthy = status != HealthStatusError
+	s.publish(LifecycleEvent{Type: HealthChanged, Health: status})
+}
+
+// publish sends the event to every subscriber without blocking, events are
+// dropped for subscribers that do not keep up. The lock has to be held.
+func (s *appState) publish(e LifecycleEvent) {
+	e.Phase = s.state.Phase
+	e.Time = time.Now()
+	for _, sub := range s.subscribers {
+		select {
+		case sub <- e:
+		default:
+		}
+	}
+}
+
+func (s *appState) subscribe() <-chan LifecycleEvent {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	ch := make(chan LifecycleEvent, subscriberBuffer)
+	if s.state.Phase == PhaseStopped || s.state.Phase == PhaseFailed {
+		close(ch)
+		return ch
+	}
+	s.subscribers = append(s.subscribers, ch)
+
+	return ch
+}
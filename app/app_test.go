@@ -1,20 +1,50 @@
 package app
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
+	jwtv5 "github.com/golang-jwt/jwt/v5"
+	"github.com/jmoiron/sqlx"
 	"github.com/ooqls/go-crypto/jwt"
 	"github.com/ooqls/go-crypto/keys"
 	"github.com/ooqls/go-db/pgx"
 	"github.com/ooqls/go-db/redis"
 	"github.com/ooqls/go-registry"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/crypto/acme"
 	"gopkg.in/yaml.v2"
 )
 
@@ -114,6 +144,2531 @@ func TestAppWithTestEnvironment(t *testing.T) {
 	wg.Wait()
 }
 
+type testFeature struct {
+	name      string
+	deps      []string
+	started   bool
+	stopped   bool
+	err       error
+	stopErr   error
+	healthErr error
+}
+
+func (f *testFeature) Name() string                     { return f.name }
+func (f *testFeature) Dependencies() []string           { return f.deps }
+func (f *testFeature) Health(ctx context.Context) error { return f.healthErr }
+
+func (f *testFeature) Start(ctx *AppContext) error {
+	f.started = true
+	return f.err
+}
+
+func (f *testFeature) Stop(ctx context.Context) error {
+	f.stopped = true
+	return f.stopErr
+}
+
+func TestAppRegisterFeature(t *testing.T) {
+	f := &testFeature{name: "custom"}
+	app := New("test", Features{})
+	app.Register(f)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := app.Run(ctx)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	assert.Truef(t, f.started, "expected feature to be started")
+	assert.Truef(t, f.stopped, "expected feature to be stopped")
+}
+
+func TestAppRegisterFeatureTwice(t *testing.T) {
+	app := New("test", Features{})
+	app.Register(&testFeature{name: "custom"})
+	app.Register(&testFeature{name: "custom"})
+
+	err := app.Run(context.Background())
+	assert.NotNilf(t, err, "expected an error for a duplicate feature")
+}
+
+func TestAppFeatureStartError(t *testing.T) {
+	first := &testFeature{name: "first"}
+	failing := &testFeature{name: "failing", err: fmt.Errorf("failed")}
+	app := New("test", Features{})
+	app.Register(first).Register(failing)
+
+	err := app.Run(context.Background())
+	assert.NotNilf(t, err, "expected the start error")
+	assert.Truef(t, first.stopped, "expected started features to be stopped")
+	assert.Falsef(t, failing.stopped, "expected failed feature not to be stopped")
+}
+
+func TestAppStopErrors(t *testing.T) {
+	app := New("test", Features{})
+	app.Register(&testFeature{name: "first", stopErr: fmt.Errorf("first failed")})
+	app.Register(&testFeature{name: "second"})
+	app.Register(&testFeature{name: "third", stopErr: fmt.Errorf("third failed")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := app.Run(ctx)
+	assert.NotNilf(t, err, "expected a stop error")
+
+	var stopErr *FeatureStopError
+	assert.Truef(t, errors.As(err, &stopErr), "expected a feature stop error, got %v", err)
+	assert.Contains(t, err.Error(), "first failed")
+	assert.Contains(t, err.Error(), "third failed")
+	assert.NotContains(t, err.Error(), "feature second")
+}
+
+func TestAppGracefulShutdown(t *testing.T) {
+	httpFeature := HTTP(WithHttpPort(8083))
+	httpFeature.Mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+	app := New("test", Features{HTTP: httpFeature}, WithStopTimeout(5*time.Second))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	resp, err := http.Get("http://localhost:8083/slow")
+	assert.Nilf(t, err, "expected in-flight request to finish, got %v", err)
+	if err == nil {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+	wg.Wait()
+}
+
+func TestAppRunsUntilCancelled(t *testing.T) {
+	app := New("test", Features{})
+	app.Register(&testFeature{name: "consumer"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Run(ctx)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+
+	select {
+	case err := <-done:
+		t.Fatalf("expected the app to run until the context is done, returned %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.True(t, app.IsRunning())
+
+	cancel()
+	assert.Nil(t, <-done)
+}
+
+func TestAppServerExit(t *testing.T) {
+	app := New("test", Features{})
+	app.OnStartup(func(ctx *AppContext) error {
+		// a TLS server without certificates stops right after it started
+		return app._serve(ctx, &http.Server{Addr: "127.0.0.1:8111", TLSConfig: &tls.Config{}}, "broken")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := app.Run(ctx)
+	assert.ErrorContains(t, err, "server broken exited")
+	assert.Nil(t, ctx.Err(), "expected the app to stop before the context is done")
+	assert.Equal(t, PhaseFailed, app.State().Phase)
+}
+
+func TestAppPortInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", "0.0.0.0:8112")
+	if !assert.Nilf(t, err, "expected no error, got %v", err) {
+		return
+	}
+	defer ln.Close()
+
+	app := New("test", Features{HTTP: HTTP(WithHttpPort(8112)), Health: Health()})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = app.Run(ctx)
+	assert.ErrorContains(t, err, "server http failed to listen")
+	assert.Equal(t, PhaseFailed, app.State().Phase)
+	assert.False(t, app.IsHealthy())
+}
+
+func getStatus(t *testing.T, url string) int {
+	resp, err := http.Get(url)
+	if !assert.Nilf(t, err, "expected no error, got %v", err) {
+		return 0
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestAppIsHealthy(t *testing.T) {
+	app := New("test", Features{})
+	var calls atomic.Int32
+	var healthErr atomic.Value
+	healthErr.Store("")
+	app.AddHealthCheck("check", func(ctx context.Context) error {
+		calls.Add(1)
+		if msg := healthErr.Load().(string); msg != "" {
+			return errors.New(msg)
+		}
+		return nil
+	})
+
+	assert.False(t, app.IsHealthy(), "expected the app not to be healthy before the checks ran")
+	app._refresh_health(context.Background())
+	assert.True(t, app.IsHealthy())
+
+	healthErr.Store("failed")
+	assert.True(t, app.IsHealthy(), "expected the last evaluation")
+	app._refresh_health(context.Background())
+	assert.False(t, app.IsHealthy())
+	assert.Equal(t, int32(2), calls.Load(), "expected IsHealthy not to run the checks")
+}
+
+func TestAppProbes(t *testing.T) {
+	unhealthy := &testFeature{name: "unhealthy"}
+	app := New("test", Features{
+		HTTP:   HTTP(WithHttpPort(8084)),
+		Gin:    Gin(WithGinPort(8085)),
+		Health: Health(),
+	})
+	app.Register(unhealthy)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+
+	for _, base := range []string{"http://localhost:8084", "http://localhost:8085"} {
+		assert.Equal(t, http.StatusOK, getStatus(t, base+DefaultLivenessPath))
+		assert.Equal(t, http.StatusOK, getStatus(t, base+DefaultStartupPath))
+		assert.Equal(t, http.StatusOK, getStatus(t, base+DefaultReadinessPath))
+	}
+
+	unhealthy.healthErr = fmt.Errorf("not ready")
+	app._refresh_health(context.Background())
+	for _, base := range []string{"http://localhost:8084", "http://localhost:8085"} {
+		assert.Equal(t, http.StatusOK, getStatus(t, base+DefaultLivenessPath))
+		assert.Equal(t, http.StatusServiceUnavailable, getStatus(t, base+DefaultReadinessPath))
+	}
+
+	cancel()
+	wg.Wait()
+	assert.Equal(t, HealthStatusError, app._check_readiness(context.Background()).Status)
+}
+
+func getReport(t *testing.T, url string) (int, HealthReport) {
+	report := HealthReport{}
+	resp, err := http.Get(url)
+	if !assert.Nilf(t, err, "expected no error, got %v", err) {
+		return 0, report
+	}
+	defer resp.Body.Close()
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&report))
+
+	return resp.StatusCode, report
+}
+
+func TestAppHealthChecks(t *testing.T) {
+	var criticalErr error
+	app := New("test", Features{
+		HTTP:   HTTP(WithHttpPort(8086)),
+		Health: Health(WithHealthInterval(1)),
+	})
+	app.AddHealthCheck("critical", func(ctx context.Context) error {
+		return criticalErr
+	})
+	app.AddHealthCheck("optional", func(ctx context.Context) error {
+		return fmt.Errorf("optional failed")
+	}, WithHealthCheckCritical(false))
+	app.AddHealthCheck("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	}, WithHealthCheckCritical(false), WithHealthCheckTimeout(10*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+
+	status, report := getReport(t, "http://localhost:8086"+DefaultReadinessPath)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, HealthStatusDegraded, report.Status)
+	assert.Empty(t, report.Checks)
+
+	criticalErr = fmt.Errorf("critical failed")
+	assert.Eventually(t, func() bool { return !app.IsHealthy() }, 5*time.Second, 100*time.Millisecond, "expected app to become unhealthy")
+	status, report = getReport(t, "http://localhost:8086"+DefaultReadinessPath+"?verbose")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, HealthStatusError, report.Status)
+	if assert.Len(t, report.Checks, 3) {
+		assert.Equal(t, "critical failed", report.Checks[0].Error)
+		assert.Equal(t, "optional failed", report.Checks[1].LastError)
+		assert.False(t, report.Checks[1].Critical)
+		assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks[2].Error)
+	}
+
+	criticalErr = nil
+	assert.Eventually(t, app.IsHealthy, 5*time.Second, 100*time.Millisecond, "expected app to become healthy")
+	_, report = getReport(t, "http://localhost:8086"+DefaultReadinessPath+"?verbose")
+	if assert.Len(t, report.Checks, 3) {
+		assert.Equal(t, HealthStatusOK, report.Checks[0].Status)
+		assert.Equal(t, "critical failed", report.Checks[0].LastError)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestAppLifecycleEvents(t *testing.T) {
+	app := New("test", Features{})
+	app.Register(&testFeature{name: "custom"})
+	assert.Equal(t, PhaseCreated, app.State().Phase)
+	events := app.Subscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app.OnRunning(func(ctx *AppContext) error {
+		<-ctx.Done()
+		return nil
+	})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+	state := app.State()
+	assert.Equal(t, PhaseRunning, state.Phase)
+	assert.Equal(t, FeatureStarted, state.Features["custom"])
+	cancel()
+	wg.Wait()
+
+	phases := []Phase{}
+	features := []FeatureStatus{}
+	for e := range events {
+		switch e.Type {
+		case PhaseChanged:
+			phases = append(phases, e.Phase)
+		case FeatureChanged:
+			features = append(features, e.FeatureStatus)
+		}
+	}
+	assert.Equal(t, []Phase{PhaseStarting, PhaseRunning, PhaseDraining, PhaseStopped}, phases)
+	assert.Equal(t, []FeatureStatus{FeatureStarting, FeatureStarted, FeatureStopping, FeatureStopped}, features)
+	assert.Equal(t, FeatureStopped, app.State().Features["custom"])
+
+	err := app.Run(context.Background())
+	assert.NotNilf(t, err, "expected an error when running a stopped app")
+}
+
+func TestAppFailedPhase(t *testing.T) {
+	app := New("test", Features{})
+	app.Register(&testFeature{name: "failing", err: fmt.Errorf("failed")})
+
+	err := app.Run(context.Background())
+	assert.NotNil(t, err)
+	state := app.State()
+	assert.Equal(t, PhaseFailed, state.Phase)
+	assert.Equal(t, FeatureFailed, state.Features["failing"])
+}
+
+func getBody(t *testing.T, url string) string {
+	resp, err := http.Get(url)
+	if !assert.Nilf(t, err, "expected no error, got %v", err) {
+		return ""
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	return string(b)
+}
+
+func TestAppMetrics(t *testing.T) {
+	httpFeature := HTTP(WithHttpPort(8087))
+	httpFeature.Mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	httpFeature.Mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	app := New("test", Features{
+		HTTP:    httpFeature,
+		Gin:     Gin(WithGinPort(8088)),
+		JWT:     JWT(),
+		Metrics: Metrics(),
+	})
+	app.OnStartup(func(ctx *AppContext) error {
+		app.Features().Gin.Engine.GET("/users/:id", func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		app.Features().Gin.Engine.GET("/panic", func(c *gin.Context) {
+			panic("boom")
+		})
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+
+	assert.Equal(t, http.StatusTeapot, getStatus(t, "http://localhost:8087/ping"))
+	assert.Equal(t, http.StatusOK, getStatus(t, "http://localhost:8088/users/1"))
+	assert.Equal(t, http.StatusOK, getStatus(t, "http://localhost:8088"+DefaultJWKSPath))
+	assert.Equal(t, http.StatusInternalServerError, getStatus(t, "http://localhost:8087/panic"))
+	assert.Equal(t, http.StatusInternalServerError, getStatus(t, "http://localhost:8088/panic"))
+
+	for _, url := range []string{"http://localhost:8087/metrics", "http://localhost:8088/metrics"} {
+		body := getBody(t, url)
+		assert.Contains(t, body, `http_requests_total{method="GET",route="/ping",server="http",status_class="4xx"} 1`)
+		assert.Contains(t, body, `http_requests_total{method="GET",route="/users/:id",server="gin",status_class="2xx"} 1`)
+		assert.Contains(t, body, `http_requests_total{method="GET",route="`+DefaultJWKSPath+`",server="gin",status_class="2xx"} 1`, "expected routes of features started before metrics to be counted")
+		assert.Contains(t, body, `http_requests_total{method="GET",route="/panic",server="gin",status_class="5xx"} 1`, "expected panics to be counted")
+		assert.Contains(t, body, `http_requests_total{method="GET",route="/panic",server="http",status_class="5xx"} 1`, "expected panics to be counted")
+		assert.Contains(t, body, `http_request_duration_seconds_bucket{method="GET",route="/ping",server="http"`)
+		assert.Contains(t, body, `http_requests_in_flight{server="http"}`)
+		assert.Contains(t, body, `app_phase{phase="running"} 1`)
+		assert.Contains(t, body, `app_feature_status{feature="metrics",status="started"} 1`)
+		assert.Contains(t, body, `go_goroutines`)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestAppMetricsOwnPort(t *testing.T) {
+	app := New("test", Features{Metrics: Metrics(WithMetricsPort(8089))})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get("http://localhost:8089/metrics")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond, "expected metrics to be served")
+
+	cancel()
+	wg.Wait()
+}
+
+// keepSpansExporter keeps the exported spans after the tracing feature is stopped.
+type keepSpansExporter struct {
+	*tracetest.InMemoryExporter
+}
+
+func (e keepSpansExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+func TestAppTracing(t *testing.T) {
+	exporter := keepSpansExporter{tracetest.NewInMemoryExporter()}
+	httpFeature := HTTP(WithHttpPort(8090))
+	httpFeature.Mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	app := New("test", Features{
+		HTTP:    httpFeature,
+		Gin:     Gin(WithGinPort(8091)),
+		Tracing: Tracing(WithSpanExporter(exporter)),
+	})
+	app.OnStartup(func(ctx *AppContext) error {
+		_, span := ctx.StartSpan("seed")
+		span.End()
+		app.Features().Gin.Engine.GET("/users/:id", func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		return nil
+	})
+	app.OnRunning(func(ctx *AppContext) error {
+		_, span := ctx.StartSpan("running")
+		span.End()
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	for _, url := range []string{"http://localhost:8090/ping", "http://localhost:8091/users/1"} {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+		req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+		resp.Body.Close()
+	}
+
+	cancel()
+	wg.Wait()
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	assert.Contains(t, spans, "startup")
+	assert.Contains(t, spans, "seed")
+	assert.Equal(t, spans["startup"].SpanContext.SpanID(), spans["seed"].Parent.SpanID(), "expected seed to be a child of startup")
+	if assert.Contains(t, spans, "running") {
+		assert.False(t, spans["running"].Parent.IsValid(), "expected spans of the running hook to be new traces")
+	}
+	for _, name := range []string{"GET /ping", "GET /users/:id"} {
+		assert.Containsf(t, spans, name, "expected a server span %s", name)
+		assert.Equal(t, traceID, spans[name].SpanContext.TraceID().String())
+		assert.True(t, spans[name].Parent.IsRemote(), "expected the parent to be propagated")
+	}
+}
+
+func TestAppTracingFile(t *testing.T) {
+	path := t.TempDir() + "/traces.json"
+	app := New("test", Features{Tracing: Tracing(WithTracingFile(path))})
+	ctx, cancel := context.WithCancel(context.Background())
+	app.OnRunning(func(ctx *AppContext) error {
+		defer cancel()
+		_, span := ctx.StartSpan("job")
+		span.End()
+		return nil
+	})
+
+	err := app.Run(ctx)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+
+	b, err := os.ReadFile(path)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	assert.Contains(t, string(b), `"Name":"startup"`)
+	assert.Contains(t, string(b), `"Name":"job"`)
+}
+
+func TestAppAccessLog(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	httpFeature := HTTP(WithHttpPort(8092))
+	httpFeature.Mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		LoggerFromContext(r.Context()).Info("ping")
+		w.WriteHeader(http.StatusTeapot)
+	})
+	app := New("test", Features{
+		HTTP:      httpFeature,
+		Gin:       Gin(WithGinPort(8093)),
+		Health:    Health(),
+		AccessLog: AccessLog(WithAccessLogExcludePaths("/skip")),
+	})
+	app.l = zap.New(core)
+	app.OnStartup(func(ctx *AppContext) error {
+		app.Features().Gin.Engine.GET("/users/:id", func(c *gin.Context) {
+			LoggerFromContext(c).Info("user")
+			c.String(http.StatusOK, "user")
+		})
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:8092/ping", nil)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	req.Header.Set("X-Request-ID", "abc")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, getStatus(t, "http://localhost:8093/users/1"))
+	getStatus(t, "http://localhost:8092/skip")
+	getStatus(t, "http://localhost:8093"+DefaultReadinessPath)
+
+	cancel()
+	wg.Wait()
+
+	requests := logs.FilterMessage("request").AllUntimed()
+	assert.Len(t, requests, 2)
+	ping := logs.FilterMessage("request").FilterField(zap.String("route", "/ping")).AllUntimed()
+	if assert.Len(t, ping, 1) {
+		fields := ping[0].ContextMap()
+		assert.Equal(t, "http", fields["server"])
+		assert.Equal(t, "GET", fields["method"])
+		assert.Equal(t, int64(http.StatusTeapot), fields["status"])
+		assert.Equal(t, "abc", fields["request_id"])
+		assert.Equal(t, "127.0.0.1", fields["client_ip"])
+	}
+	user := logs.FilterMessage("request").FilterField(zap.String("route", "/users/:id")).AllUntimed()
+	if assert.Len(t, user, 1) {
+		assert.Equal(t, int64(len("user")), user[0].ContextMap()["bytes"])
+	}
+	assert.Equal(t, 1, logs.FilterMessage("ping").FilterField(zap.String("request_id", "abc")).Len(), "expected the request logger in the handler")
+	assert.Equal(t, 1, logs.FilterMessage("user").FilterField(zap.String("server", "gin")).Len(), "expected the request logger in the gin handler")
+}
+
+func TestAppHTTPStreaming(t *testing.T) {
+	httpFeature := HTTP(WithHttpPort(8110))
+	flushed := make(chan struct{})
+	httpFeature.Mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !assert.True(t, ok, "expected the wrapped writer to be a flusher") {
+			return
+		}
+		w.Write([]byte("first\n"))
+		flusher.Flush()
+		<-flushed
+		w.Write([]byte("second\n"))
+	})
+	httpFeature.Mux.HandleFunc("/upgrade", func(w http.ResponseWriter, r *http.Request) {
+		hijacker, ok := w.(http.Hijacker)
+		if !assert.True(t, ok, "expected the wrapped writer to be a hijacker") {
+			return
+		}
+		conn, rw, err := hijacker.Hijack()
+		if !assert.Nilf(t, err, "expected no error, got %v", err) {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\nhello")
+		rw.Flush()
+	})
+	app := New("test", Features{
+		HTTP:      httpFeature,
+		Metrics:   Metrics(),
+		AccessLog: AccessLog(),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+
+	resp, err := http.Get("http://localhost:8110/stream")
+	if assert.Nilf(t, err, "expected no error, got %v", err) {
+		body := bufio.NewReader(resp.Body)
+		line, err := body.ReadString('\n')
+		assert.Nilf(t, err, "expected no error, got %v", err)
+		assert.Equal(t, "first\n", line, "expected the first chunk before the handler returns")
+		close(flushed)
+		line, err = body.ReadString('\n')
+		assert.Nilf(t, err, "expected no error, got %v", err)
+		assert.Equal(t, "second\n", line)
+		resp.Body.Close()
+	}
+
+	conn, err := net.Dial("tcp", "localhost:8110")
+	if assert.Nilf(t, err, "expected no error, got %v", err) {
+		conn.Write([]byte("GET /upgrade HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if assert.Nilf(t, err, "expected no error, got %v", err) {
+			assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		}
+		conn.Close()
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	al := &accessLog{l: zap.New(core), sampleRate: 0}
+	for i := 0; i < 10; i++ {
+		al.log(al.l, "/", http.StatusOK, 0, "", time.Millisecond)
+	}
+	al.log(al.l, "/", http.StatusInternalServerError, 0, "", time.Millisecond)
+	assert.Equal(t, 1, logs.Len(), "expected only server errors to be logged")
+}
+
+func TestAppRequestID(t *testing.T) {
+	forwarded := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Get(RequestIDHeader)
+	}))
+	defer upstream.Close()
+
+	var appCtx *AppContext
+	httpFeature := HTTP(WithHttpPort(8094))
+	httpFeature.Mux.HandleFunc("/call", func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, upstream.URL, nil)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+		resp, err := appCtx.HTTPClient().Do(req)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+		resp.Body.Close()
+	})
+	app := New("test", Features{
+		HTTP: httpFeature,
+		Gin:  Gin(WithGinPort(8095)),
+	})
+	app.OnStartup(func(ctx *AppContext) error {
+		appCtx = ctx
+		app.Features().Gin.Engine.GET("/id", func(c *gin.Context) {
+			assert.Equal(t, c.GetString(RequestIDKey), RequestIDFromContext(c))
+			c.String(http.StatusOK, RequestIDFromContext(c))
+		})
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+
+	resp, err := http.Get("http://localhost:8094/call")
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	resp.Body.Close()
+	id := resp.Header.Get(RequestIDHeader)
+	assert.NotEmpty(t, id, "expected a generated request ID")
+	assert.Equal(t, id, <-forwarded, "expected the request ID to be forwarded")
+
+	for header, expected := range map[string]bool{"abc": true, strings.Repeat("a", 200): false, "a b": false} {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:8095/id", nil)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+		req.Header.Set(RequestIDHeader, header)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, string(b), resp.Header.Get(RequestIDHeader))
+		assert.Equalf(t, expected, header == string(b), "unexpected request ID for %q", header)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestAppRecovery(t *testing.T) {
+	panics := make(chan interface{}, 2)
+	httpFeature := HTTP(WithHttpPort(8096))
+	httpFeature.Mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("http handler")
+	})
+	app := New("test", Features{
+		HTTP: httpFeature,
+		Gin:  Gin(WithGinPort(8097)),
+	})
+	app.OnPanic(func(err interface{}) {
+		panics <- err
+	})
+	app.OnStartup(func(ctx *AppContext) error {
+		app.Features().Gin.Engine.GET("/panic", func(c *gin.Context) {
+			panic("gin handler")
+		})
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+
+	for url, expected := range map[string]string{
+		"http://localhost:8096/panic": "http handler",
+		"http://localhost:8097/panic": "gin handler",
+	} {
+		resp, err := http.Get(url)
+		if !assert.Nilf(t, err, "expected no error, got %v", err) {
+			continue
+		}
+		var problem Problem
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&problem))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		assert.Equal(t, ProblemContentType, resp.Header.Get("Content-Type"))
+		assert.Equal(t, http.StatusInternalServerError, problem.Status)
+		assert.Equal(t, resp.Header.Get(RequestIDHeader), problem.RequestID)
+		assert.Equal(t, expected, <-panics)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestAppRecoveryRunning(t *testing.T) {
+	panics := make(chan interface{}, 1)
+	app := New("test", Features{})
+	ctx, cancel := context.WithCancel(context.Background())
+	app.OnPanic(func(err interface{}) {
+		panics <- err
+		cancel()
+	})
+	app.OnRunning(func(ctx *AppContext) error {
+		panic("running")
+	})
+
+	err := app.Run(ctx)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	assert.Equal(t, "running", <-panics)
+}
+
+func TestAppRecoveryStartup(t *testing.T) {
+	panics := make(chan interface{}, 1)
+	f := &testFeature{name: "custom"}
+	app := New("test", Features{})
+	app.Register(f)
+	app.OnPanic(func(err interface{}) {
+		panics <- err
+	})
+	app.OnStartup(func(ctx *AppContext) error {
+		panic("startup")
+	})
+
+	err := app.Run(context.Background())
+	assert.ErrorContains(t, err, "recovered from panic: startup")
+	assert.Equal(t, "startup", <-panics)
+	assert.Equal(t, PhaseFailed, app.State().Phase)
+	assert.True(t, f.stopped, "expected the started features to be stopped")
+}
+
+func TestConfigLoader(t *testing.T) {
+	dir := t.TempDir()
+	base := dir + "/base.yaml"
+	override := dir + "/override.yaml"
+	assert.Nil(t, os.WriteFile(base, []byte("gin:\n  enabled: true\n  port: 9000\n  cors:\n    origins: [a.com]\ntls:\n  cert_file: base.pem\n"), 0644))
+	assert.Nil(t, os.WriteFile(override, []byte("gin:\n  port: 9001\n"), 0644))
+	t.Setenv("APP_GIN_PORT", "9002")
+	t.Setenv("APP_TLS_CERT_FILE", "env.pem")
+	t.Setenv("APP_GIN_CORS_ORIGINS", "b.com, c.com")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("tls-cert-path", "", "")
+	assert.Nil(t, fs.Parse([]string{"-tls-cert-path", "flag.pem"}))
+
+	ec, err := NewConfigLoader(WithConfigFiles(base, override), WithFlagSet(fs)).Load()
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	cfg := ec.Config
+	assert.True(t, cfg.Gin.Enabled)
+	assert.Equal(t, 9002, cfg.Gin.Port)
+	assert.Equal(t, "flag.pem", cfg.TLS.CertFile)
+	assert.Equal(t, []string{"b.com", "c.com"}, cfg.Gin.Cors.AllowOrigins)
+	assert.Equal(t, 30, cfg.Health.Interval)
+
+	assert.Equal(t, "file:"+base, ec.Source("gin.enabled"))
+	assert.Equal(t, "env:APP_GIN_PORT", ec.Source("gin.port"))
+	assert.Equal(t, "flag:tls-cert-path", ec.Source("tls.cert_file"))
+	assert.Equal(t, "default", ec.Source("health.interval"))
+
+	var dump strings.Builder
+	assert.Nil(t, ec.Dump(&dump))
+	assert.Contains(t, dump.String(), "gin.port: 9002 # env:APP_GIN_PORT\n")
+	assert.Contains(t, dump.String(), `gin.cors.origins: ["b.com","c.com"] # env:APP_GIN_CORS_ORIGINS`)
+
+	t.Setenv("APP_GIN_PORT", "not-a-port")
+	_, err = NewConfigLoader(WithFlagSet(nil)).Load()
+	assert.NotNilf(t, err, "expected an error for an invalid env value")
+}
+
+func TestLoadConfigStrict(t *testing.T) {
+	cfg, err := LoadConfig("../app_config.example.yaml")
+	assert.Nilf(t, err, "expected the example config to load, got %v", err)
+	if assert.NotNil(t, cfg) {
+		assert.Equal(t, []string{"./sql"}, cfg.SQLFiles.SQLFilesDirs)
+	}
+
+	path := t.TempDir() + "/app.yaml"
+	assert.Nil(t, os.WriteFile(path, []byte("sql:\n  enabled: true\n  sql_files_dir: ./sql\n"), 0644))
+	_, err = LoadConfig(path)
+	if assert.NotNilf(t, err, "expected an error for an unknown key") {
+		assert.Contains(t, err.Error(), "line 3")
+		assert.Contains(t, err.Error(), "sql_files_dir")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	path := t.TempDir() + "/app.yaml"
+	assert.Nil(t, os.WriteFile(path, []byte(`gin:
+  enabled: true
+  port: 8080
+  cors:
+    enabled: true
+    allow_all_origins: true
+    allow_credentials: true
+http:
+  enabled: true
+  port: 8080
+logging_api:
+  enabled: true
+  port: 70000
+tls:
+  enabled: true
+  cert_file: missing.pem
+sql:
+  sql_package: MYSQL
+`), 0644))
+
+	cfg, err := LoadConfig(path)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	err = cfg.Validate()
+	var verr *ConfigValidationError
+	if !assert.Truef(t, errors.As(err, &verr), "expected a validation error, got %v", err) {
+		return
+	}
+
+	problems := map[string]string{}
+	for _, p := range verr.Problems {
+		problems[p.Key] = p.Position
+	}
+	assert.Equal(t, path+":10", problems["http.port"])
+	assert.Equal(t, path+":13", problems["logging_api.port"])
+	assert.Equal(t, path+":16", problems["tls.cert_file"])
+	assert.Equal(t, path+":18", problems["sql.sql_package"])
+	assert.Equal(t, path+":7", problems["gin.cors.allow_credentials"])
+	assert.Contains(t, err.Error(), path+":10: http.port: port 8080 is already used by gin.port")
+
+	t.Setenv("APP_HTTP_PORT", "8081")
+	ec, err := NewConfigLoader(WithConfigFiles(path), WithFlagSet(nil)).Load()
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	err = ec.Config.Validate()
+	assert.NotContains(t, err.Error(), "http.port")
+	assert.Contains(t, err.Error(), path+":13: logging_api.port")
+
+	assert.Nil(t, (&AppConfig{}).Validate())
+
+	err = (&AppConfig{TLS: TLSConfig{
+		Enabled:          true,
+		ClientAuth:       "verify",
+		ServerClientAuth: map[string]string{"grpc": "none", "gin": "always"},
+	}}).Validate()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "tls.client_auth: client auth verify needs ca_path")
+		assert.Contains(t, err.Error(), "unknown server grpc")
+		assert.Contains(t, err.Error(), `unknown client auth mode "always"`)
+	}
+
+	err = (&AppConfig{TLS: TLSConfig{
+		Enabled: true,
+		ACME:    ACMEConfig{Enabled: true, Domains: []string{"localhost"}},
+	}}).Validate()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "domain localhost is not a fully qualified domain name")
+	}
+
+	err = (&AppConfig{Auth: AuthConfig{Enabled: true, Path: "token"}}).Validate()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "auth.enabled: auth is enabled but jwt is not")
+		assert.Contains(t, err.Error(), "auth.enabled: auth needs gin or http")
+		assert.Contains(t, err.Error(), "auth.path: path token has to start with /")
+	}
+
+	err = (&AppConfig{JWT: JWTConfig{Enabled: true, RemoteJWKS: []RemoteJWKS{{URL: "https://accounts.example.com/jwks.json"}}}}).Validate()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "jwt.remote_jwks: jwks https://accounts.example.com/jwks.json needs the issuers its keys verify tokens of")
+	}
+
+	assert.Nil(t, (&AppConfig{
+		Gin:        GinConfig{Enabled: true, Port: 8080},
+		DocsConfig: DocsConfig{Enabled: true, DocsPort: 8080},
+	}).Validate(), "expected the docs port not to collide, docs are served by gin and http")
+
+	err = (&AppConfig{
+		JWT:     JWTConfig{Enabled: true, KeyDir: "/run/secrets/jwt-keys"},
+		secrets: map[string]bool{"jwt.key_dir": true},
+	}).Validate()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "jwt.key_dir: directory "+RedactedValue+" does not exist")
+		assert.NotContains(t, err.Error(), "/run/secrets/jwt-keys")
+	}
+}
+
+func TestConfigSecrets(t *testing.T) {
+	dir := t.TempDir()
+	secret := dir + "/registry"
+	assert.Nil(t, os.WriteFile(secret, []byte("secret-registry.db\n"), 0644))
+	path := dir + "/app.yaml"
+	assert.Nil(t, os.WriteFile(path, []byte(`registry:
+  path: ${file:`+secret+`}
+tls:
+  cert_file: /certs/${env:TEST_CERT_NAME}.pem
+gin:
+  cors:
+    origins: [a.com, "${vault:origin}"]
+`), 0644))
+	t.Setenv("TEST_CERT_NAME", "server")
+
+	_, err := LoadConfig(path)
+	if assert.NotNilf(t, err, "expected an error for an unknown scheme") {
+		assert.Contains(t, err.Error(), "no secret resolver for vault")
+	}
+
+	vault := SecretResolverFunc(func(ref string) (string, error) {
+		return "vault-" + ref, nil
+	})
+	ec, err := NewConfigLoader(WithConfigFiles(path), WithFlagSet(nil), WithSecretResolver("vault", vault)).Load()
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	cfg := ec.Config
+	assert.Equal(t, "secret-registry.db", cfg.Registry.Path)
+	assert.Equal(t, "/certs/server.pem", cfg.TLS.CertFile)
+	assert.Equal(t, []string{"a.com", "vault-origin"}, cfg.Gin.Cors.AllowOrigins)
+	assert.True(t, cfg.IsSecret("registry.path"))
+	assert.False(t, cfg.IsSecret("gin.port"))
+
+	var dump strings.Builder
+	assert.Nil(t, ec.Dump(&dump))
+	assert.Contains(t, dump.String(), `registry.path: "[REDACTED]" # file:`+path+", secret")
+	assert.NotContains(t, dump.String(), "secret-registry.db")
+	assert.NotContains(t, dump.String(), "vault-origin")
+	assert.NotContains(t, cfg.String(), "secret-registry.db")
+	assert.NotContains(t, fmt.Sprint(cfg), "/certs/server.pem")
+	assert.Equal(t, "secret-registry.db", cfg.Registry.Path, "expected redaction not to change the config")
+}
+
+func TestConfigSecretsNested(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/app.yaml"
+	assert.Nil(t, os.WriteFile(path, []byte(`jwt:
+  token_configurations:
+    - issuer: ${env:TEST_ISSUER}
+  remote_jwks:
+    - url: ${env:TEST_JWKS_URL}
+      issuers: [sibling]
+tls:
+  server_client_auth:
+    http: ${env:TEST_CLIENT_AUTH}
+`), 0644))
+	t.Setenv("TEST_ISSUER", "api")
+	t.Setenv("TEST_JWKS_URL", "https://sibling/jwks.json")
+	t.Setenv("TEST_CLIENT_AUTH", "verify")
+	t.Setenv("TEST_ORIGIN", "a.com")
+
+	defaults := DefaultConfig()
+	defaults.Gin.Cors.AllowOrigins = []string{"${env:TEST_ORIGIN}"}
+	ec, err := NewConfigLoader(WithConfigFiles(path), WithFlagSet(nil), WithConfigDefaults(defaults)).Load()
+	if !assert.Nilf(t, err, "expected no error, got %v", err) {
+		return
+	}
+	cfg := ec.Config
+	assert.Equal(t, []string{"a.com"}, cfg.Gin.Cors.AllowOrigins)
+	assert.Equal(t, []string{"${env:TEST_ORIGIN}"}, defaults.Gin.Cors.AllowOrigins, "expected the defaults not to change")
+	if assert.Len(t, cfg.JWT.TokenConfigurations, 1) {
+		assert.Equal(t, "api", cfg.JWT.TokenConfigurations[0].Issuer)
+	}
+	if assert.Len(t, cfg.JWT.RemoteJWKS, 1) {
+		assert.Equal(t, "https://sibling/jwks.json", cfg.JWT.RemoteJWKS[0].URL)
+	}
+	assert.Equal(t, "verify", cfg.TLS.ServerClientAuth["http"])
+	assert.True(t, cfg.IsSecret("jwt.token_configurations"))
+	assert.NotContains(t, cfg.String(), "sibling/jwks.json")
+	assert.Equal(t, "https://sibling/jwks.json", cfg.JWT.RemoteJWKS[0].URL, "expected redaction not to change the config")
+
+	assert.Nil(t, os.WriteFile(path, []byte("tls:\n  server_client_auth:\n    ${env:TEST_CLIENT_AUTH}: verify\n"), 0644))
+	_, err = NewConfigLoader(WithConfigFiles(path), WithFlagSet(nil)).Load()
+	assert.ErrorContains(t, err, "secret references in keys are not resolved")
+}
+
+func TestAppConfigReload(t *testing.T) {
+	path := t.TempDir() + "/app.yaml"
+	write := func(origin string, port int, validity int) {
+		assert.Nil(t, os.WriteFile(path, []byte(fmt.Sprintf(`gin:
+  enabled: true
+  port: 8098
+  cors:
+    enabled: true
+    origins: [%s]
+http:
+  enabled: true
+  port: %d
+jwt:
+  enabled: true
+  token_configurations:
+    - issuer: auth
+      audience: [app]
+      validity_duration_seconds: %d
+health:
+  interval: 30
+log:
+  level: info
+`, origin, port, validity)), 0644))
+	}
+	write("http://a.com", 8099, 60)
+
+	loader := NewConfigLoader(WithConfigFiles(path), WithFlagSet(nil))
+	ec, err := loader.Load()
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	app := New("test", WithConfig(ec.Config), WithConfigReload(loader, ec.Config), WithConfigWatchInterval(20*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+	app.Features().Gin.Engine.GET("/cors", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	allowed := func(origin string) string {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:8098/cors", nil)
+		req.Header.Set("Origin", origin)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return ""
+		}
+		resp.Body.Close()
+		return resp.Header.Get("Access-Control-Allow-Origin")
+	}
+	assert.Equal(t, "http://a.com", allowed("http://a.com"))
+
+	write("http://b.com", 8099, 120)
+	assert.Eventually(t, func() bool {
+		return allowed("http://b.com") == "http://b.com"
+	}, 5*time.Second, 20*time.Millisecond, "expected the cors origins to be reloaded")
+	assert.Empty(t, allowed("http://a.com"))
+	assert.Eventually(t, func() bool {
+		cfg, ok := app.appCtx.AuthIssuerConfig()
+		return ok && cfg.ValidityDurationSeconds == 120
+	}, 5*time.Second, 20*time.Millisecond, "expected the token configurations to be reloaded")
+
+	assert.Nil(t, os.WriteFile(path, []byte("log:\n  level: LOUD\n"), 0644))
+	_, err = app.ReloadConfig()
+	assert.NotNilf(t, err, "expected an invalid config to be rejected")
+	assert.Equal(t, "http://b.com", allowed("http://b.com"), "expected the config to be kept")
+
+	cancel()
+	wg.Wait()
+
+	// the watcher is stopped, reload directly to see what is reported
+	write("http://b.com", 8100, 120)
+	reload, err := app.ReloadConfig()
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	if assert.NotNil(t, reload) {
+		assert.Equal(t, []string{"http.port"}, reload.RestartRequired)
+		assert.Empty(t, reload.Applied)
+	}
+}
+
+func TestAppConfigReloadTokenFile(t *testing.T) {
+	dir := t.TempDir()
+	path, tokens := dir+"/app.yaml", dir+"/auth.yaml"
+	write := func(origin string) {
+		assert.Nil(t, os.WriteFile(path, []byte(fmt.Sprintf(`gin:
+  enabled: true
+  port: 8114
+  cors:
+    enabled: true
+    origins: [%s]
+jwt:
+  enabled: true
+  token_configuration_paths: [%s]
+`, origin, tokens)), 0644))
+	}
+	writeTokens := func(content string) {
+		assert.Nil(t, os.WriteFile(tokens, []byte(content), 0644))
+	}
+	writeTokens("issuer: auth\nvalidity_duration_seconds: 60\n")
+	write("http://a.com")
+
+	loader := NewConfigLoader(WithConfigFiles(path), WithFlagSet(nil))
+	ec, err := loader.Load()
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	app := New("test", WithConfig(ec.Config), WithConfigReload(loader, ec.Config), WithConfigWatchInterval(20*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+
+	writeTokens("issuer: auth\nvalidity_duration_seconds: 120\n")
+	assert.Eventually(t, func() bool {
+		cfg, ok := app._app_ctx().AuthIssuerConfig()
+		return ok && cfg.ValidityDurationSeconds == 120
+	}, 5*time.Second, 20*time.Millisecond, "expected the token configuration file to be watched")
+
+	cors := app.cors.Load()
+	writeTokens("issuer: [")
+	write("http://b.com")
+	_, err = app.ReloadConfig()
+	assert.NotNilf(t, err, "expected the broken token configuration to fail the reload")
+	assert.Same(t, cors, app.cors.Load(), "expected the cors not to be applied")
+	app.configM.Lock()
+	assert.Equal(t, []string{"http://a.com"}, app.config.Gin.Cors.AllowOrigins)
+	app.configM.Unlock()
+
+	cancel()
+	wg.Wait()
+}
+
+func TestAppTLSReload(t *testing.T) {
+	ca, err := keys.CreateX509CA()
+	assert.Nilf(t, err, "should be able to create CA")
+	_, caCertPem := ca.Pem()
+	caPath := writeFile(t, string(caCertPem))
+	certPath, keyPath := writeFile(t, ""), writeFile(t, "")
+	writeServerCert(t, *ca, certPath, keyPath)
+
+	app := New("test", Features{
+		TLS: TLS(
+			WithServerCAFile(caPath),
+			WithServerCert(certPath),
+			WithServerKey(keyPath),
+			WithCertReloadInterval(20*time.Millisecond),
+		),
+		HTTP: HTTP(WithHttpPort(8099)),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caCertPem)
+	served := func() *x509.Certificate {
+		conn, err := tls.Dial("tcp", "localhost:8099", &tls.Config{RootCAs: pool, ServerName: "localhost"})
+		if !assert.Nilf(t, err, "expected no error, got %v", err) {
+			return nil
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+
+	first := served()
+	if !assert.NotNil(t, first) {
+		cancel()
+		wg.Wait()
+		return
+	}
+	assert.Equal(t, first.NotAfter, app.State().TLSCertificateExpiry)
+
+	second := writeServerCert(t, *ca, certPath, keyPath)
+	assert.Eventually(t, func() bool {
+		cert := served()
+		return cert != nil && cert.SerialNumber.Cmp(second.SerialNumber) == 0
+	}, 5*time.Second, 20*time.Millisecond, "expected the new certificate to be served")
+	assert.Equal(t, second.NotAfter, app.State().TLSCertificateExpiry)
+
+	// a key that does not match the certificate is rejected
+	_, otherKey := writeServerCertPem(t, *ca)
+	assert.Nil(t, os.WriteFile(keyPath, otherKey, 0644))
+	assert.NotNil(t, app._reload_tls(app.appCtx), "expected a mismatched key pair to be rejected")
+	assert.Equal(t, second.SerialNumber, served().SerialNumber, "expected the current certificate to be kept")
+
+	cancel()
+	wg.Wait()
+}
+
+func TestAppMutualTLS(t *testing.T) {
+	ca, err := keys.CreateX509CA(keys.WithExtKeyUsage([]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}))
+	assert.Nilf(t, err, "should be able to create CA")
+	_, caCertPem := ca.Pem()
+	caPath := writeFile(t, string(caCertPem))
+	certPath, keyPath := writeFile(t, ""), writeFile(t, "")
+	writeServerCert(t, *ca, certPath, keyPath)
+
+	client, err := keys.CreateX509(*ca,
+		keys.WithCommonName("client-1"),
+		keys.WithExtKeyUsage([]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}),
+	)
+	assert.Nilf(t, err, "should be able to create client cert")
+	clientKeyPem, clientCertPem := client.Pem()
+	clientCert, err := tls.X509KeyPair(clientCertPem, clientKeyPem)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+
+	app := New("test", Features{
+		TLS: TLS(
+			WithServerCAFile(caPath),
+			WithServerCert(certPath),
+			WithServerKey(keyPath),
+			WithServerClientAuth(GinFeatureName, ClientAuthVerify),
+		),
+		Gin:        Gin(WithGinPort(8101)),
+		LoggingAPI: LoggingApi(WithLoggingApiPort(8102)),
+	})
+	app.OnStartup(func(ctx *AppContext) error {
+		app.Features().Gin.Engine.GET("/whoami", func(c *gin.Context) {
+			id, ok := ClientIdentityFromRequest(c.Request)
+			if !ok {
+				c.Status(http.StatusUnauthorized)
+				return
+			}
+			c.String(http.StatusOK, id.CommonName)
+		})
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caCertPem)
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs},
+		}}
+	}
+
+	_, err = newClient().Get("https://localhost:8101/whoami")
+	assert.NotNilf(t, err, "expected gin to require a client certificate")
+
+	resp, err := newClient(clientCert).Get("https://localhost:8101/whoami")
+	if assert.Nilf(t, err, "expected no error, got %v", err) {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "client-1", string(body))
+	}
+
+	resp, err = newClient().Get("https://localhost:8102/")
+	if assert.Nilf(t, err, "expected the logging api not to require a client certificate, got %v", err) {
+		resp.Body.Close()
+	}
+
+	upstreamCertPem, upstreamKeyPem := writeServerCertPem(t, *ca)
+	upstreamCert, err := tls.X509KeyPair(upstreamCertPem, upstreamKeyPem)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, len(r.TLS.PeerCertificates))
+	}))
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{upstreamCert}, ClientAuth: tls.RequestClientCert}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	resp, err = app._app_ctx().HTTPClient().Get(fmt.Sprintf("https://localhost:%d", upstream.Listener.Addr().(*net.TCPAddr).Port))
+	if assert.Nilf(t, err, "expected the app client to trust the CA, got %v", err) {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "0", string(body), "expected the app client not to present the server certificate")
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+func TestAppDevCerts(t *testing.T) {
+	dir := t.TempDir() + "/certs"
+	run := func() []byte {
+		app := New("test", Features{
+			TLS: TLS(WithDevCerts("app.local"), WithDevCertDir(dir)),
+			Gin: Gin(WithGinPort(8103)),
+		})
+		app.OnStartup(func(ctx *AppContext) error {
+			app.Features().Gin.Engine.GET("/ping", func(c *gin.Context) {
+				c.String(http.StatusOK, "pong")
+			})
+			return nil
+		})
+
+		var body []byte
+		ctx, cancel := context.WithCancel(context.Background())
+		app.OnRunning(func(ctx *AppContext) error {
+			defer cancel()
+			resp, err := ctx.HTTPClient().Get("https://localhost:8103/ping")
+			if !assert.Nilf(t, err, "expected the app client to trust the dev CA, got %v", err) {
+				return nil
+			}
+			defer resp.Body.Close()
+			body, _ = io.ReadAll(resp.Body)
+			return nil
+		})
+
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+		assert.Equal(t, "pong", string(body))
+		return app.Features().TLS.ServerCertBytes
+	}
+
+	first := run()
+	info, err := os.Stat(dir + "/key.pem")
+	if assert.Nilf(t, err, "expected the key to be written, got %v", err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	assert.Equal(t, first, run(), "expected the written certificate to be reused")
+
+	_, ok := readDevCerts(dir, devCertHosts([]string{"other.local"}))
+	assert.False(t, ok, "expected a certificate without the host not to be reused")
+}
+
+// acmeTestCA is a minimal ACME server for a single order. It does not verify
+// the signatures of requests and validates the challenge when it is accepted.
+type acmeTestCA struct {
+	t   *testing.T
+	srv *httptest.Server
+	// challenge is the only challenge type offered, it is validated against
+	// addr, the plain HTTP port of the app for http-01 or its TLS port for
+	// tls-alpn-01.
+	challenge string
+	addr      string
+
+	key *ecdsa.PrivateKey
+	ca  *x509.Certificate
+	pem []byte
+
+	m          sync.Mutex
+	nonce      int
+	thumbprint string
+	domain     string
+	authz      string
+	order      string
+	chain      []byte
+}
+
+const acmeTestToken = "test-token"
+
+func newACMETestCA(t *testing.T, challenge, addr string) *acmeTestCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ca key: %v", err)
+	}
+
+	serial, _ := newSerialNumber()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "acme test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create ca certificate: %v", err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	c := &acmeTestCA{
+		t:         t,
+		challenge: challenge,
+		addr:      addr,
+		key:       key,
+		ca:        ca,
+		pem:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		authz:     acme.StatusPending,
+		order:     acme.StatusPending,
+	}
+	c.srv = httptest.NewServer(http.HandlerFunc(c.serve))
+	t.Cleanup(c.srv.Close)
+
+	return c
+}
+
+func (c *acmeTestCA) url(path string) string {
+	return c.srv.URL + path
+}
+
+func (c *acmeTestCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.ca)
+	return pool
+}
+
+// reply writes v as json, every response carries a fresh nonce.
+func (c *acmeTestCA) reply(w http.ResponseWriter, status int, location string, v interface{}) {
+	c.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", c.nonce))
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	if v == nil {
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// decode returns the decoded protected header and payload of a flattened JWS.
+func (c *acmeTestCA) decode(r *http.Request) (protected map[string]json.RawMessage, payload []byte) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, nil
+	}
+
+	b, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	_ = json.Unmarshal(b, &protected)
+	payload, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+	return protected, payload
+}
+
+func (c *acmeTestCA) keyAuth() string {
+	return acmeTestToken + "." + c.thumbprint
+}
+
+func (c *acmeTestCA) orderJSON() map[string]interface{} {
+	o := map[string]interface{}{
+		"status":         c.order,
+		"identifiers":    []map[string]string{{"type": "dns", "value": c.domain}},
+		"authorizations": []string{c.url("/authz/1")},
+		"finalize":       c.url("/finalize/1"),
+	}
+	if c.chain != nil {
+		o["certificate"] = c.url("/cert/1")
+	}
+
+	return o
+}
+
+func (c *acmeTestCA) challengeJSON() map[string]string {
+	status := acme.StatusPending
+	if c.authz == acme.StatusValid {
+		status = acme.StatusValid
+	}
+
+	return map[string]string{"type": c.challenge, "url": c.url("/chall/1"), "token": acmeTestToken, "status": status}
+}
+
+func (c *acmeTestCA) serve(w http.ResponseWriter, r *http.Request) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if r.URL.Path == "/directory" {
+		c.reply(w, http.StatusOK, "", map[string]string{
+			"newNonce":   c.url("/nonce"),
+			"newAccount": c.url("/account"),
+			"newOrder":   c.url("/order"),
+			"revokeCert": c.url("/revoke"),
+			"keyChange":  c.url("/key-change"),
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		c.reply(w, http.StatusOK, "", nil)
+		return
+	}
+
+	protected, payload := c.decode(r)
+	switch r.URL.Path {
+	case "/account":
+		var jwk struct{ Crv, X, Y string }
+		_ = json.Unmarshal(protected["jwk"], &jwk)
+		sum := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk.Crv, jwk.X, jwk.Y)))
+		c.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+		c.reply(w, http.StatusCreated, c.url("/account/1"), map[string]string{"status": acme.StatusValid})
+	case "/order":
+		var req struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		_ = json.Unmarshal(payload, &req)
+		c.domain = req.Identifiers[0].Value
+		c.reply(w, http.StatusCreated, c.url("/order/1"), c.orderJSON())
+	case "/order/1":
+		c.reply(w, http.StatusOK, c.url("/order/1"), c.orderJSON())
+	case "/authz/1":
+		c.reply(w, http.StatusOK, "", map[string]interface{}{
+			"status":     c.authz,
+			"identifier": map[string]string{"type": "dns", "value": c.domain},
+			"challenges": []map[string]string{c.challengeJSON()},
+		})
+	case "/chall/1":
+		if err := c.validate(); err != nil {
+			c.t.Errorf("challenge %s failed: %v", c.challenge, err)
+			c.authz = acme.StatusInvalid
+			c.order = acme.StatusInvalid
+		} else {
+			c.authz = acme.StatusValid
+			c.order = acme.StatusReady
+		}
+		c.reply(w, http.StatusOK, "", c.challengeJSON())
+	case "/finalize/1":
+		var req struct{ CSR string }
+		_ = json.Unmarshal(payload, &req)
+		if err := c.issue(req.CSR); err != nil {
+			c.t.Errorf("failed to issue certificate: %v", err)
+			c.order = acme.StatusInvalid
+		} else {
+			c.order = acme.StatusValid
+		}
+		c.reply(w, http.StatusOK, c.url("/order/1"), c.orderJSON())
+	case "/cert/1":
+		c.nonce++
+		w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", c.nonce))
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(c.chain)
+	default:
+		c.reply(w, http.StatusNotFound, "", map[string]string{"type": "urn:ietf:params:acme:error:malformed"})
+	}
+}
+
+// validate checks that the app serves the key authorization of the challenge.
+func (c *acmeTestCA) validate() error {
+	if c.challenge == "http-01" {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+c.addr+acmeChallengePath+acmeTestToken, nil)
+		req.Host = c.domain
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		b, _ := io.ReadAll(resp.Body)
+		if string(b) != c.keyAuth() {
+			return fmt.Errorf("expected key authorization %s, got %d %s", c.keyAuth(), resp.StatusCode, b)
+		}
+		return nil
+	}
+
+	conn, err := tls.Dial("tcp", c.addr, &tls.Config{
+		ServerName:         c.domain,
+		NextProtos:         []string{acme.ALPNProto},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	want := sha256.Sum256([]byte(c.keyAuth()))
+	for _, ext := range leaf.Extensions {
+		if !ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) {
+			continue
+		}
+		var got []byte
+		if _, err := asn1.Unmarshal(ext.Value, &got); err != nil {
+			return err
+		}
+		if string(got) != string(want[:]) {
+			return fmt.Errorf("acme identifier does not match the key authorization")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("challenge certificate has no acme identifier")
+}
+
+// issue signs the csr with the CA.
+func (c *acmeTestCA) issue(b64 string) error {
+	der, err := base64.RawURLEncoding.DecodeString(b64)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+
+	serial, _ := newSerialNumber()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, c.ca, csr.PublicKey, c.key)
+	if err != nil {
+		return err
+	}
+
+	c.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), c.pem...)
+	return nil
+}
+
+func acmeGet(t *testing.T, ca *acmeTestCA, url string) (string, error) {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: ca.pool(), ServerName: "app.localhost"},
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
+func TestAppACMETLSALPN(t *testing.T) {
+	ca := newACMETestCA(t, "tls-alpn-01", "127.0.0.1:8104")
+	dir := t.TempDir()
+	app := New("test", Features{
+		TLS: TLS(WithACME("app.localhost"), WithACMEDirectoryURL(ca.url("/directory")), WithACMECacheDir(dir)),
+		Gin: Gin(WithGinPort(8104)),
+	})
+	app.OnStartup(func(ctx *AppContext) error {
+		app.Features().Gin.Engine.GET("/ping", func(c *gin.Context) {
+			c.String(http.StatusOK, "pong")
+		})
+		return nil
+	})
+
+	var body string
+	ctx, cancel := context.WithCancel(context.Background())
+	app.OnRunning(func(ctx *AppContext) error {
+		defer cancel()
+		var err error
+		body, err = acmeGet(t, ca, "https://127.0.0.1:8104/ping")
+		assert.Nilf(t, err, "expected a certificate issued by the ACME CA, got %v", err)
+		return nil
+	})
+
+	err := app.Run(ctx)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	assert.Equal(t, "pong", body)
+	assert.False(t, app.State().TLSCertificateExpiry.IsZero(), "expected the expiry of the ACME certificate")
+
+	_, err = os.Stat(filepath.Join(dir, "app.localhost"))
+	assert.Nilf(t, err, "expected the certificate to be cached, got %v", err)
+}
+
+func TestAppACMEHTTP01(t *testing.T) {
+	ca := newACMETestCA(t, "http-01", "127.0.0.1:8106")
+	httpFeature := HTTP(WithHttpPort(8105))
+	httpFeature.Mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("pong"))
+	})
+	app := New("test", Features{
+		TLS:  TLS(WithACME("app.localhost"), WithACMEDirectoryURL(ca.url("/directory")), WithACMEHTTPPort(8106)),
+		HTTP: httpFeature,
+	})
+
+	var body string
+	var redirect int
+	ctx, cancel := context.WithCancel(context.Background())
+	app.OnRunning(func(ctx *AppContext) error {
+		defer cancel()
+		var err error
+		body, err = acmeGet(t, ca, "https://127.0.0.1:8105/ping")
+		assert.Nilf(t, err, "expected a certificate issued by the ACME CA, got %v", err)
+		challenge, err := acmeGet(t, ca, "https://127.0.0.1:8105"+acmeChallengePath+acmeTestToken)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+		assert.Contains(t, challenge, "acme/autocert", "expected the challenges on the http mux")
+
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+		resp, err := client.Get("http://127.0.0.1:8106/ping")
+		if assert.Nilf(t, err, "expected no error, got %v", err) {
+			resp.Body.Close()
+			redirect = resp.StatusCode
+		}
+		return nil
+	})
+
+	err := app.Run(ctx)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	assert.Equal(t, "pong", body)
+	assert.Equal(t, http.StatusFound, redirect, "expected plain requests to be redirected to https")
+}
+
+func TestAppACMEHTTPPortInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", "0.0.0.0:8113")
+	if !assert.Nilf(t, err, "expected no error, got %v", err) {
+		return
+	}
+	defer ln.Close()
+
+	app := New("test", Features{
+		TLS: TLS(WithACME("app.localhost"), WithACMEDirectoryURL("http://127.0.0.1:1/directory"), WithACMEHTTPPort(8113)),
+	})
+	err = app.Run(context.Background())
+	assert.ErrorContains(t, err, "server acme failed to listen")
+	assert.Equal(t, PhaseFailed, app.State().Phase)
+}
+
+func TestRequireJWT(t *testing.T) {
+	rsa, err := keys.NewRSA()
+	assert.Nilf(t, err, "should be able to create RSA")
+	keys.SetJwt(keys.NewJWTKey(*rsa))
+	cfg := jwt.TokenConfiguration{Issuer: AuthIssuer, Audience: []string{"api"}, ValidityDurationSeconds: 60}
+	ctx := NewAppContext(context.Background(), zap.NewNop())
+	ctx.setTokenConfigs(map[string]jwt.TokenConfiguration{AuthIssuer: cfg})
+
+	issue := func(cfg jwt.TokenConfiguration, key keys.JwtSigningKey) string {
+		token, _, err := jwt.NewJwtTokenIssuer[map[string]string](&cfg, key).IssueToken("user-1", map[string]string{"role": "admin"})
+		assert.Nilf(t, err, "should be able to issue a token")
+		return token
+	}
+	otherRSA, err := keys.NewRSA()
+	assert.Nilf(t, err, "should be able to create RSA")
+	expired := cfg
+	expired.ValidityDurationSeconds = -60
+	otherIssuer := cfg
+	otherIssuer.Issuer = RefreshIssuer
+	otherAudience := cfg
+	otherAudience.Audience = []string{"admin-api"}
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/me", ctx.RequireJWT(AuthIssuer), func(c *gin.Context) {
+		claims, _ := JWTClaimsFromContext(c)
+		custom, err := CustomClaimsFromContext[map[string]string](c)
+		assert.Nilf(t, err, "expected the custom claims, got %v", err)
+		c.String(http.StatusOK, claims.Subject+" "+custom["role"])
+	})
+	engine.GET("/admin", ctx.RequireJWT(AuthIssuer, WithJWTAuthorize(func(r *http.Request, claims *JWTClaims) error {
+		return errors.New("admins only")
+	})), func(c *gin.Context) {})
+
+	do := func(handler http.Handler, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(engine, "/me", issue(cfg, keys.JWT()))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "user-1 admin", rec.Body.String())
+
+	for name, test := range map[string]struct {
+		path, token string
+		status      int
+		detail      string
+	}{
+		"missing":        {"/me", "", http.StatusUnauthorized, "a bearer token is required"},
+		"malformed":      {"/me", "not-a-token", http.StatusUnauthorized, "the token is invalid"},
+		"other key":      {"/me", issue(cfg, keys.NewJWTKey(*otherRSA)), http.StatusUnauthorized, "the token is invalid"},
+		"expired":        {"/me", issue(expired, keys.JWT()), http.StatusUnauthorized, "the token is expired"},
+		"other issuer":   {"/me", issue(otherIssuer, keys.JWT()), http.StatusUnauthorized, "the token was not issued by auth"},
+		"other audience": {"/me", issue(otherAudience, keys.JWT()), http.StatusForbidden, "the token is not meant for this audience"},
+		"not authorized": {"/admin", issue(cfg, keys.JWT()), http.StatusForbidden, "admins only"},
+	} {
+		rec := do(engine, test.path, test.token)
+		assert.Equalf(t, test.status, rec.Code, "%s: unexpected status", name)
+		assert.Equalf(t, ProblemContentType, rec.Header().Get("Content-Type"), "%s: expected a problem", name)
+		var p Problem
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &p))
+		assert.Equalf(t, test.detail, p.Detail, "%s: unexpected detail", name)
+		if test.status == http.StatusUnauthorized {
+			assert.NotEmptyf(t, rec.Header().Get("WWW-Authenticate"), "%s: expected a challenge", name)
+		}
+	}
+
+	handler := ctx.RequireJWTHandler(AuthIssuer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := JWTClaimsFromContext(r.Context())
+		assert.True(t, ok, "expected the claims in the request context")
+		_, _ = w.Write([]byte(claims.Subject))
+	}), WithJWTAudience("admin-api"))
+	rec = do(handler, "/", issue(otherAudience, keys.JWT()))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "user-1", rec.Body.String())
+	assert.Equal(t, http.StatusForbidden, do(handler, "/", issue(cfg, keys.JWT())).Code)
+
+	ctx.setTokenConfigs(map[string]jwt.TokenConfiguration{})
+	assert.Equal(t, http.StatusInternalServerError, do(handler, "/", issue(otherAudience, keys.JWT())).Code)
+}
+
+func TestAppAuth(t *testing.T) {
+	app := New("test", Features{
+		JWT: JWT(WithTokenConfigurations([]jwt.TokenConfiguration{
+			{Issuer: AuthIssuer, Audience: []string{"api"}, ValidityDurationSeconds: 60},
+			{Issuer: RefreshIssuer, Audience: []string{"auth"}, ValidityDurationSeconds: 3600},
+		})),
+		Gin: Gin(WithGinPort(8107)),
+		Auth: Auth(WithCredentialValidator(CredentialValidatorFunc(func(ctx context.Context, c Credentials) (string, error) {
+			if c.Username != "user-1" || c.Password != "secret" {
+				return "", ErrInvalidCredentials
+			}
+			return c.Username, nil
+		}))),
+	})
+	app.OnStartup(func(ctx *AppContext) error {
+		app.Features().Gin.Engine.GET("/me", ctx.RequireJWT(AuthIssuer), func(c *gin.Context) {
+			claims, _ := JWTClaimsFromContext(c)
+			c.String(http.StatusOK, claims.Subject)
+		})
+		return nil
+	})
+
+	post := func(path string, body interface{}) (int, TokenResponse) {
+		b, _ := json.Marshal(body)
+		resp, err := http.Post("http://localhost:8107"+path, "application/json", strings.NewReader(string(b)))
+		if !assert.Nilf(t, err, "expected no error, got %v", err) {
+			return 0, TokenResponse{}
+		}
+		defer resp.Body.Close()
+
+		var tokens TokenResponse
+		_ = json.NewDecoder(resp.Body).Decode(&tokens)
+		return resp.StatusCode, tokens
+	}
+	refresh := func(token string) (int, TokenResponse) {
+		return post("/token/refresh", map[string]string{"refresh_token": token})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app.OnRunning(func(ctx *AppContext) error {
+		defer cancel()
+		status, _ := post("/token", Credentials{Username: "user-1", Password: "wrong"})
+		assert.Equal(t, http.StatusUnauthorized, status)
+
+		status, login := post("/token", Credentials{Username: "user-1", Password: "secret"})
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "Bearer", login.TokenType)
+		assert.Equal(t, int64(60), login.ExpiresIn)
+
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:8107/me", nil)
+		req.Header.Set("Authorization", "Bearer "+login.AccessToken)
+		resp, err := http.DefaultClient.Do(req)
+		if assert.Nilf(t, err, "expected no error, got %v", err) {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, "user-1", string(body))
+		}
+
+		status, _ = refresh(login.AccessToken)
+		assert.Equal(t, http.StatusUnauthorized, status, "expected an access token not to refresh")
+
+		status, rotated := refresh(login.RefreshToken)
+		assert.Equal(t, http.StatusOK, status)
+		assert.NotEqual(t, login.RefreshToken, rotated.RefreshToken, "expected the refresh token to be rotated")
+
+		status, _ = refresh(login.RefreshToken)
+		assert.Equal(t, http.StatusUnauthorized, status, "expected a used refresh token to be rejected")
+		status, _ = refresh(rotated.RefreshToken)
+		assert.Equal(t, http.StatusUnauthorized, status, "expected the reuse to revoke the family")
+
+		_, other := post("/token", Credentials{Username: "user-1", Password: "secret"})
+		status, _ = post("/token/revoke", map[string]string{"refresh_token": other.RefreshToken})
+		assert.Equal(t, http.StatusOK, status)
+		status, _ = refresh(other.RefreshToken)
+		assert.Equal(t, http.StatusUnauthorized, status, "expected a revoked refresh token to be rejected")
+
+		status, _ = post("/token/revoke", map[string]string{"refresh_token": "invalid"})
+		assert.Equal(t, http.StatusOK, status)
+		return nil
+	})
+
+	err := app.Run(ctx)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+}
+
+func TestAppAuthMissingTokenConfig(t *testing.T) {
+	app := New("test", Features{
+		JWT:  JWT(),
+		Gin:  Gin(WithGinPort(8108)),
+		Auth: Auth(),
+	})
+
+	err := app.Run(context.Background())
+	if assert.NotNil(t, err, "expected auth to need the token configurations") {
+		assert.Contains(t, err.Error(), "token configuration for issuer auth")
+	}
+}
+
+func TestMemoryRefreshTokenStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryRefreshTokenStore()
+	expiresAt := time.Now().Add(time.Hour)
+	assert.Nil(t, s.Save(ctx, RefreshToken{ID: "t1", Family: "f", ExpiresAt: expiresAt}))
+
+	// the client rotates t1 while a stolen copy of it is replayed
+	_, ok, err := s.Use(ctx, "t1")
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	reused, _, _ := s.Use(ctx, "t1")
+	assert.True(t, reused.Used)
+	assert.Nil(t, s.RevokeFamily(ctx, "f"))
+
+	err = s.Save(ctx, RefreshToken{ID: "t2", Family: "f", ExpiresAt: expiresAt})
+	assert.ErrorIs(t, err, ErrRefreshTokenRevoked, "expected the revoked family to stay revoked")
+	_, ok, _ = s.Get(ctx, "t2")
+	assert.False(t, ok)
+
+	store := s.(*memoryRefreshTokenStore)
+	assert.Nil(t, s.Save(ctx, RefreshToken{ID: "expired", Family: "g", ExpiresAt: time.Now().Add(-time.Second)}))
+	assert.Nil(t, s.Save(ctx, RefreshToken{ID: "t3", Family: "h", ExpiresAt: expiresAt}))
+	_, ok, _ = s.Get(ctx, "expired")
+	assert.True(t, ok, "expected no sweep before the interval passed")
+
+	store.swept = time.Now().Add(-refreshTokenSweepInterval)
+	assert.Nil(t, s.Save(ctx, RefreshToken{ID: "t4", Family: "h", ExpiresAt: expiresAt}))
+	_, ok, _ = s.Get(ctx, "expired")
+	assert.False(t, ok, "expected the expired token to be swept")
+	_, ok, _ = s.Get(ctx, "t3")
+	assert.True(t, ok)
+}
+
+// siblingJWKS serves the JWKS of another service, its key can be rotated.
+type siblingJWKS struct {
+	srv     *httptest.Server
+	fetches atomic.Int32
+	m       sync.Mutex
+	kid     string
+	key     *rsa.PrivateKey
+}
+
+func newSiblingJWKS(t *testing.T) *siblingJWKS {
+	s := &siblingJWKS{}
+	s.rotate(t, "sibling-1")
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.m.Lock()
+		defer s.m.Unlock()
+		_ = json.NewEncoder(w).Encode(JWKS{Keys: []JWK{newRSAJWK(s.kid, &s.key.PublicKey)}})
+	}))
+	t.Cleanup(s.srv.Close)
+
+	return s
+}
+
+func (s *siblingJWKS) rotate(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nilf(t, err, "should be able to create RSA key")
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.kid, s.key = kid, key
+}
+
+func (s *siblingJWKS) sign(t *testing.T, kid string) string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	token := jwtv5.NewWithClaims(jwtv5.SigningMethodRS256, jwtv5.RegisteredClaims{
+		Issuer:    "sibling",
+		Subject:   "service-1",
+		Audience:  []string{"api"},
+		ExpiresAt: jwtv5.NewNumericDate(time.Now().Add(time.Minute)),
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(s.key)
+	assert.Nilf(t, err, "should be able to sign token")
+	return signed
+}
+
+func TestAppJWKS(t *testing.T) {
+	sibling := newSiblingJWKS(t)
+	app := New("test", Features{
+		JWT: JWT(
+			WithTokenConfigurations([]jwt.TokenConfiguration{{Issuer: "sibling", Audience: []string{"api"}}}),
+			WithRemoteJWKS(sibling.srv.URL, "sibling"),
+			WithJWKSRefreshInterval(50*time.Millisecond),
+		),
+		Gin: Gin(WithGinPort(8109)),
+	})
+	app.OnStartup(func(ctx *AppContext) error {
+		app.Features().Gin.Engine.GET("/me", ctx.RequireJWT("sibling"), func(c *gin.Context) {
+			claims, _ := JWTClaimsFromContext(c)
+			c.String(http.StatusOK, claims.Subject)
+		})
+		return nil
+	})
+
+	get := func(token string) int {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:8109/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.Nilf(t, err, "expected no error, got %v", err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app.OnRunning(func(ctx *AppContext) error {
+		defer cancel()
+		resp, err := http.Get("http://localhost:8109" + DefaultJWKSPath)
+		if assert.Nilf(t, err, "expected no error, got %v", err) {
+			var set JWKS
+			assert.Nil(t, json.NewDecoder(resp.Body).Decode(&set))
+			resp.Body.Close()
+			if assert.Len(t, set.Keys, 1) {
+				assert.Equal(t, ctx.jwtKeys.current().kid, set.Keys[0].Kid)
+				pub, err := set.Keys[0].rsaPublicKey()
+				assert.Nilf(t, err, "expected an RSA key, got %v", err)
+				assert.True(t, pub.Equal(ctx.jwtKeys.current().pub), "expected the signing key")
+			}
+		}
+		assert.Nil(t, app._health_jwt(ctx), "expected the remote jwks to be fetched")
+
+		assert.Equal(t, http.StatusOK, get(sibling.sign(t, "sibling-1")))
+		assert.Equal(t, http.StatusUnauthorized, get(sibling.sign(t, "")), "expected a token without kid to need the app key")
+
+		sibling.rotate(t, "sibling-2")
+		assert.Eventually(t, func() bool {
+			return get(sibling.sign(t, "sibling-2")) == http.StatusOK
+		}, 5*time.Second, 50*time.Millisecond, "expected the rotated key to be fetched")
+		assert.Equal(t, http.StatusUnauthorized, get(sibling.sign(t, "sibling-1")))
+		return nil
+	})
+
+	err := app.Run(ctx)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+}
+
+func TestJWTKeysRemoteUnknownKid(t *testing.T) {
+	sibling := newSiblingJWKS(t)
+	rsaKey, err := keys.NewRSA()
+	assert.Nilf(t, err, "should be able to create RSA")
+	priv, _ := rsaKey.PrivateKey()
+
+	ctx := NewAppContext(context.Background(), zap.NewNop())
+	ctx.jwtKeys = newJWTKeys(newJWTKey(&priv), nil, nil, []RemoteJWKS{{URL: sibling.srv.URL, Issuers: []string{"sibling"}}})
+	assert.NotNil(t, ctx.jwtKeys.health(), "expected the remote jwks not to be fetched yet")
+
+	_, err = jwtv5.Parse(sibling.sign(t, "sibling-1"), ctx.jwtKey("api"))
+	assert.NotNil(t, err, "expected the remote jwks not to verify tokens of other issuers")
+	assert.Equal(t, int32(0), sibling.fetches.Load(), "expected no fetch for an issuer the jwks is not trusted for")
+
+	token, err := jwtv5.Parse(sibling.sign(t, "sibling-1"), ctx.jwtKey("sibling"))
+	assert.Nilf(t, err, "expected an unknown kid to fetch the remote jwks, got %v", err)
+	assert.True(t, token.Valid)
+
+	wg := sync.WaitGroup{}
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := jwtv5.Parse(sibling.sign(t, fmt.Sprintf("random-%d", i)), ctx.jwtKey("sibling"))
+			assert.NotNil(t, err, "expected an unknown kid to be rejected")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), sibling.fetches.Load(), "expected unknown kids not to fetch the jwks again right away")
+}
+
+func TestAppJWTMissingKeys(t *testing.T) {
+	privKeyPath, pubKeyPath := writeRSA(t)
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	cases := map[string]JWTFeature{
+		"private key":  JWT(WithJWTPrivateKeyPath(missing), WithJWTPublicKeyPath(pubKeyPath)),
+		"public key":   JWT(WithJWTPrivateKeyPath(privKeyPath), WithJWTPublicKeyPath(missing)),
+		"only one key": JWT(WithJWTPrivateKeyPath(privKeyPath), WithJWTPublicKeyPath("")),
+		"key dir":      JWT(WithJWTKeyDir(filepath.Join(t.TempDir(), "missing"))),
+		"previous key": JWT(WithJWTPreviousKeys(missing)),
+	}
+
+	for name, f := range cases {
+		t.Run(name, func(t *testing.T) {
+			app := New("test", Features{JWT: f})
+			err := app.Run(context.Background())
+			assert.NotNilf(t, err, "expected configured but missing keys to fail the startup")
+		})
+	}
+}
+
+func TestAppJWTKeyDir(t *testing.T) {
+	dir := t.TempDir()
+	run := func() (kid string) {
+		app := New("test", Features{JWT: JWT(WithJWTKeyDir(dir))})
+		ctx, cancel := context.WithCancel(context.Background())
+		app.OnRunning(func(ctx *AppContext) error {
+			defer cancel()
+			kid = ctx.jwtKeys.current().kid
+			return nil
+		})
+
+		err := app.Run(ctx)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+		return kid
+	}
+
+	kid := run()
+	assert.NotEmpty(t, kid)
+	assert.Equal(t, kid, run(), "expected the key written to the dir to sign after a restart")
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1, "expected one key to be generated") {
+		info, err := entries[0].Info()
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+func TestAppJWTKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	app := New("test", Features{
+		JWT: JWT(
+			WithTokenConfigurations([]jwt.TokenConfiguration{{Issuer: "api"}}),
+			WithJWTKeyDir(dir),
+			WithJWTKeyRotation(300*time.Millisecond),
+			WithJWTMaxPreviousKeys(1),
+		),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app.OnRunning(func(ctx *AppContext) error {
+		defer cancel()
+		cfg, _ := ctx.TokenConfig("api")
+		first := ctx.jwtKeys.current()
+		token, err := ctx.signJWT(jwtv5.RegisteredClaims{
+			Issuer:    "api",
+			ExpiresAt: jwtv5.NewNumericDate(time.Now().Add(time.Minute)),
+		})
+		assert.Nilf(t, err, "expected no error, got %v", err)
+
+		assert.Eventually(t, func() bool {
+			return ctx.jwtKeys.current().kid != first.kid
+		}, 20*time.Second, 50*time.Millisecond, "expected the signing key to be rotated")
+		_, err = ctx.parseJWT(token, cfg, nil, 0)
+		assert.Nilf(t, err, "expected the previous key to verify, got %v", err)
+		assert.Len(t, ctx.jwtKeys.jwks().Keys, 2)
+
+		second := ctx.jwtKeys.current()
+		assert.Eventually(t, func() bool {
+			return ctx.jwtKeys.current().kid != second.kid
+		}, 20*time.Second, 50*time.Millisecond, "expected the signing key to be rotated again")
+		_, err = ctx.parseJWT(token, cfg, nil, 0)
+		assert.NotNil(t, err, "expected the dropped key not to verify")
+		assert.NoFileExists(t, first.path, "expected the dropped key to be removed")
+		return nil
+	})
+
+	err := app.Run(ctx)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+}
+
+func TestAppJWTMaxPreviousKeys(t *testing.T) {
+	none, one := 0, 1
+	cases := []struct {
+		name     string
+		features Features
+		want     int
+	}{
+		{name: "literal", features: Features{JWT: JWTFeature{Enabled: true, RotationInterval: time.Hour}}, want: 2},
+		{name: "default", features: Features{JWT: JWT()}, want: 2},
+		{name: "option", features: Features{JWT: JWT(WithJWTMaxPreviousKeys(1))}, want: 1},
+		{name: "option none", features: Features{JWT: JWT(WithJWTMaxPreviousKeys(0))}, want: 0},
+		{name: "negative", features: Features{JWT: JWTFeature{Enabled: true, MaxPreviousKeys: -1}}, want: 0},
+		{name: "config", features: WithConfig(&AppConfig{}), want: 2},
+		{name: "config one", features: WithConfig(&AppConfig{JWT: JWTConfig{MaxPreviousKeys: &one}}), want: 1},
+		{name: "config none", features: WithConfig(&AppConfig{JWT: JWTConfig{MaxPreviousKeys: &none}}), want: 0},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, New("test", c.features)._max_previous_jwt_keys(), c.name)
+	}
+}
+
+func TestAppJWTPreviousKeys(t *testing.T) {
+	privKeyPath, pubKeyPath := writeRSA(t)
+	previous, err := readJWTKey(privKeyPath)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+
+	app := New("test", Features{
+		JWT: JWT(
+			WithTokenConfigurations([]jwt.TokenConfiguration{{Issuer: "api"}}),
+			WithJWTPreviousKeys(pubKeyPath),
+		),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app.OnRunning(func(ctx *AppContext) error {
+		defer cancel()
+		cfg, _ := ctx.TokenConfig("api")
+		token := jwtv5.NewWithClaims(jwtv5.SigningMethodRS256, jwtv5.RegisteredClaims{
+			Issuer:    "api",
+			ExpiresAt: jwtv5.NewNumericDate(time.Now().Add(time.Minute)),
+		})
+		token.Header["kid"] = previous.kid
+		signed, err := token.SignedString(previous.priv)
+		assert.Nilf(t, err, "expected no error, got %v", err)
+
+		_, err = ctx.parseJWT(signed, cfg, nil, 0)
+		assert.Nilf(t, err, "expected the previous key to verify, got %v", err)
+		assert.NotEqual(t, previous.kid, ctx.jwtKeys.current().kid, "expected the previous key not to sign")
+		assert.Len(t, ctx.jwtKeys.jwks().Keys, 2)
+		return nil
+	})
+
+	err = app.Run(ctx)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+}
+
+type reloadFeature struct {
+	testFeature
+	reloaded chan struct{}
+}
+
+func (f *reloadFeature) Reload(ctx *AppContext) error {
+	f.reloaded <- struct{}{}
+	return nil
+}
+
+func runWithSignals(t *testing.T, app *app) *sync.WaitGroup {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals can not be sent to the own process on windows")
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := app.Run(context.Background())
+		assert.Nilf(t, err, "expected no error, got %v", err)
+	}()
+	assert.Eventually(t, app.IsRunning, 5*time.Second, 10*time.Millisecond, "expected app to be running")
+
+	return wg
+}
+
+func sendSignal(t *testing.T, sig os.Signal) {
+	p, err := os.FindProcess(os.Getpid())
+	if assert.Nilf(t, err, "expected no error, got %v", err) {
+		assert.Nil(t, p.Signal(sig))
+	}
+}
+
+func TestAppSignalShutdown(t *testing.T) {
+	app := New("test", Features{}, WithSignalHandling())
+	app.OnRunning(func(ctx *AppContext) error {
+		<-ctx.Done()
+		return nil
+	})
+
+	wg := runWithSignals(t, app)
+	sendSignal(t, syscall.SIGTERM)
+	wg.Wait()
+}
+
+func TestAppSignalForceExit(t *testing.T) {
+	exited := make(chan int, 1)
+	osExit = func(code int) { exited <- code }
+	defer func() { osExit = os.Exit }()
+
+	release := make(chan struct{})
+	app := New("test", Features{}, WithSignalHandling())
+	app.OnRunning(func(ctx *AppContext) error {
+		<-release
+		return nil
+	})
+
+	wg := runWithSignals(t, app)
+	sendSignal(t, syscall.SIGINT)
+	time.Sleep(50 * time.Millisecond)
+	sendSignal(t, syscall.SIGINT)
+
+	select {
+	case code := <-exited:
+		assert.Equal(t, 1, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the second signal to force an exit")
+	}
+	close(release)
+	wg.Wait()
+}
+
+func TestAppSignalReload(t *testing.T) {
+	f := &reloadFeature{testFeature: testFeature{name: "reloadable"}, reloaded: make(chan struct{}, 1)}
+	hook := make(chan struct{}, 1)
+	app := New("test", Features{}, WithSignalHandling())
+	app.Register(f)
+	app.OnReload(func(ctx *AppContext) error {
+		hook <- struct{}{}
+		return nil
+	})
+
+	app.OnRunning(func(ctx *AppContext) error {
+		<-ctx.Done()
+		return nil
+	})
+
+	wg := runWithSignals(t, app)
+	sendSignal(t, syscall.SIGHUP)
+
+	for _, ch := range []chan struct{}{f.reloaded, hook} {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected SIGHUP to reload the app")
+		}
+	}
+
+	sendSignal(t, syscall.SIGTERM)
+	wg.Wait()
+}
+
+type countingReloadFeature struct {
+	testFeature
+	stopping atomic.Bool
+	reloads  atomic.Int32
+	stale    atomic.Int32
+}
+
+func (f *countingReloadFeature) Reload(ctx *AppContext) error {
+	f.reloads.Add(1)
+	if f.stopping.Load() {
+		f.stale.Add(1)
+	}
+	return nil
+}
+
+func (f *countingReloadFeature) Stop(ctx context.Context) error {
+	f.stopping.Store(true)
+	return nil
+}
+
+func TestAppReloadWhileStopping(t *testing.T) {
+	f := &countingReloadFeature{testFeature: testFeature{name: "reloadable"}}
+	app := New("test", Features{})
+	app.Register(f)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app.OnRunning(func(ctx *AppContext) error {
+		defer cancel()
+		assert.Eventually(t, func() bool { return f.reloads.Load() > 0 }, 5*time.Second, time.Millisecond)
+		return nil
+	})
+
+	stop := make(chan struct{})
+	reloading := make(chan struct{})
+	go func() {
+		defer close(reloading)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = app._reload()
+			}
+		}
+	}()
+
+	err := app.Run(ctx)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	close(stop)
+	<-reloading
+
+	assert.Nil(t, app._reload(), "expected a reload of a stopped app to be dropped")
+	assert.Equal(t, int32(0), f.stale.Load(), "expected a stopping feature not to be reloaded")
+}
+
+func TestAppSQLStopWhileHealthChecking(t *testing.T) {
+	db, err := sqlx.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	app := New("test", Features{})
+	app._set_sqlx(db)
+
+	wg := sync.WaitGroup{}
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				_ = app._health_sql(ctx)
+				cancel()
+			}
+		}()
+	}
+
+	assert.Nil(t, app._stop_sql(context.Background()))
+	wg.Wait()
+	assert.Nil(t, app._health_sql(context.Background()), "expected a stopped SQL feature not to be pinged")
+}
+
+func TestOrderFeatures(t *testing.T) {
+	features := []Feature{
+		&testFeature{name: "a", deps: []string{"c"}},
+		&testFeature{name: "b"},
+		&testFeature{name: "c", deps: []string{"b"}},
+		&testFeature{name: "d"},
+	}
+
+	ordered, err := orderFeatures(features)
+	assert.Nilf(t, err, "expected no error, got %v", err)
+	names := []string{}
+	for _, f := range ordered {
+		names = append(names, f.Name())
+	}
+	assert.Equal(t, []string{"b", "c", "a", "d"}, names)
+}
+
+func TestOrderFeaturesCycle(t *testing.T) {
+	features := []Feature{
+		&testFeature{name: "a", deps: []string{"b"}},
+		&testFeature{name: "b", deps: []string{"c"}},
+		&testFeature{name: "c", deps: []string{"a"}},
+	}
+
+	_, err := orderFeatures(features)
+	assert.NotNilf(t, err, "expected a cycle error")
+	assert.Contains(t, err.Error(), "a -> b -> c -> a")
+}
+
+func TestOrderFeaturesUnknownDependency(t *testing.T) {
+	f := &testFeature{name: "a", deps: []string{"kafka"}}
+	app := New("test", Features{})
+	app.Register(f)
+
+	err := app.Run(context.Background())
+	assert.NotNilf(t, err, "expected an unknown dependency error")
+	assert.Falsef(t, f.started, "expected feature not to be started")
+}
+
 func writeFile(t *testing.T, content string) string {
 	path, err := os.CreateTemp("/tmp/", "test-*")
 	assert.Nilf(t, err, "expected no error, got %v", err)
@@ -174,6 +2729,31 @@ func writeTLS(t *testing.T) (caPath, certPath, keyPath string) {
 	return
 }
 
+// writeServerCertPem creates a certificate for localhost signed by ca.
+func writeServerCertPem(t *testing.T, ca keys.X509) (certPem, keyPem []byte) {
+	cert, err := keys.CreateX509(ca,
+		keys.WithDNSNames([]string{"localhost"}),
+		keys.WithExtKeyUsage([]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}),
+	)
+	assert.Nilf(t, err, "should be able to create cert")
+	keyPem, certPem = cert.Pem()
+
+	return certPem, keyPem
+}
+
+// writeServerCert replaces the files at certPath and keyPath with a new
+// certificate signed by ca and returns it.
+func writeServerCert(t *testing.T, ca keys.X509, certPath, keyPath string) *x509.Certificate {
+	certPem, keyPem := writeServerCertPem(t, ca)
+	assert.Nil(t, os.WriteFile(keyPath, keyPem, 0644))
+	assert.Nil(t, os.WriteFile(certPath, certPem, 0644))
+
+	block, _ := pem.Decode(certPem)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	assert.Nilf(t, err, "should be able to parse cert")
+	return cert
+}
+
 func writeToken(t *testing.T) string {
 	token := jwt.TokenConfiguration{
 		Issuer:                  "issuer",
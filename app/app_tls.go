@@ -0,0 +1,319 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const defaultCertReloadInterval = 10 * time.Second
+
+// certReloader holds the server certificate and the CA pool of the TLS
+// feature. They are served through GetCertificate and GetConfigForClient, so
+// reload can swap them while the servers are running.
+type certReloader struct {
+	f          TLSFeature
+	l          *zap.Logger
+	m          sync.Mutex
+	acme       *autocert.Manager
+	onCert     func(leaf *x509.Certificate)
+	cert       atomic.Pointer[tls.Certificate]
+	pool       atomic.Pointer[x509.CertPool]
+	clientPool atomic.Pointer[x509.CertPool]
+}
+
+// newCertReloader returns a reloader of the certificate of f, onCert is
+// called with every certificate that is put in use.
+func newCertReloader(f TLSFeature, l *zap.Logger, onCert func(leaf *x509.Certificate)) *certReloader {
+	return &certReloader{f: f, l: l, onCert: onCert}
+}
+
+// files returns the files the certificate and the CA pool are loaded from.
+func (r *certReloader) files() []string {
+	files := []string{}
+	if r.acme == nil && len(r.f.ServerCertBytes) == 0 && r.f.ServerCertFile != "" {
+		files = append(files, r.f.ServerCertFile)
+	}
+	if r.acme == nil && len(r.f.ServerKeyBytes) == 0 && r.f.ServerKeyFile != "" {
+		files = append(files, r.f.ServerKeyFile)
+	}
+	if len(r.f.CABytes) == 0 && r.f.CAFile != "" {
+		files = append(files, r.f.CAFile)
+	}
+
+	return files
+}
+
+func (r *certReloader) loadPool() (*x509.CertPool, error) {
+	f := r.f
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get system cert pool: %v", err)
+	}
+
+	if len(f.CABytes) > 0 {
+		ok := pool.AppendCertsFromPEM(f.CABytes)
+		if !ok {
+			return nil, fmt.Errorf("failed to append all ca bytes")
+		}
+	} else if f.CAFile != "" {
+		b, err := os.ReadFile(f.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file %s: %v", f.CAFile, err)
+		}
+
+		ok := pool.AppendCertsFromPEM(b)
+		if !ok {
+			return nil, fmt.Errorf("failed to add pem bytes from ca file %s", f.CAFile)
+		}
+	}
+
+	return pool, nil
+}
+
+func (r *certReloader) loadCert() (*tls.Certificate, error) {
+	f := r.f
+	var err error
+	var certBytes, keyBytes []byte
+
+	if len(f.ServerCertBytes) > 0 {
+		certBytes = f.ServerCertBytes
+	} else if f.ServerCertFile != "" {
+		certBytes, err = os.ReadFile(f.ServerCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cert file %s: %v", f.ServerCertFile, err)
+		}
+	} else {
+		return nil, fmt.Errorf("no server cert given for TLS")
+	}
+
+	if len(f.ServerKeyBytes) > 0 {
+		keyBytes = f.ServerKeyBytes
+	} else if f.ServerKeyFile != "" {
+		keyBytes, err = os.ReadFile(f.ServerKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file %s: %v", f.ServerKeyFile, err)
+		}
+	} else {
+		return nil, fmt.Errorf("no server key gven for tls")
+	}
+
+	cert, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key pair: %v", err)
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+
+	return &cert, nil
+}
+
+// reload loads the certificate and the CA pool. When one of them is invalid
+// the current ones are kept and an error is returned, a replacement
+// certificate that already expired is rejected as well. With ACME only the
+// CA pool is loaded, the certificates are obtained on demand.
+func (r *certReloader) reload() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	pool, err := r.loadPool()
+	if err != nil {
+		return err
+	}
+
+	clientPool, err := r.f.clientCAs()
+	if err != nil {
+		return err
+	}
+
+	if r.acme != nil {
+		r.pool.Store(pool)
+		r.clientPool.Store(clientPool)
+		return nil
+	}
+
+	cert, err := r.loadCert()
+	if err != nil {
+		return err
+	}
+
+	current := r.cert.Load()
+	if current != nil && time.Now().After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("new server certificate expired at %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	r.pool.Store(pool)
+	r.clientPool.Store(clientPool)
+	r.use(cert)
+
+	return nil
+}
+
+// use puts cert in use, it is logged when it is a different certificate.
+func (r *certReloader) use(cert *tls.Certificate) {
+	current := r.cert.Swap(cert)
+	if current != nil && current.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) == 0 {
+		return
+	}
+
+	r.l.Info("[TLS] using server certificate",
+		zap.String("subject", cert.Leaf.Subject.String()),
+		zap.String("serial", cert.Leaf.SerialNumber.String()),
+		zap.Time("not_after", cert.Leaf.NotAfter))
+	if r.onCert != nil {
+		r.onCert(cert.Leaf)
+	}
+}
+
+// GetCertificate returns the current server certificate. With ACME the
+// certificate of the requested host is obtained or renewed, or the
+// certificate of a TLS-ALPN-01 challenge is returned.
+func (r *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if r.acme == nil {
+		return r.cert.Load(), nil
+	}
+
+	cert, err := r.acme.GetCertificate(hello)
+	if err != nil || cert.Leaf == nil || slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return cert, err
+	}
+
+	r.use(cert)
+	return cert, nil
+}
+
+// Leaf returns the parsed current certificate.
+func (r *certReloader) Leaf() *x509.Certificate {
+	cert := r.cert.Load()
+	if cert == nil {
+		return nil
+	}
+
+	return cert.Leaf
+}
+
+// serverConfig returns the tls config of a server, every handshake uses the
+// current certificate and client CA pool.
+func (r *certReloader) serverConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	nextProtos := []string{"h2", "http/1.1"}
+	if r.acme != nil {
+		nextProtos = append(nextProtos, acme.ALPNProto)
+	}
+
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		ClientAuth:     clientAuth,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				GetCertificate: r.GetCertificate,
+				ClientAuth:     clientAuth,
+				ClientCAs:      r.clientPool.Load(),
+				NextProtos:     nextProtos,
+			}, nil
+		},
+	}
+}
+
+// clientConfig returns the tls config of the app client, it trusts the CA
+// pool the client was created with. The client never presents the server
+// certificate to the servers it calls.
+func (r *certReloader) clientConfig() *tls.Config {
+	return &tls.Config{RootCAs: r.pool.Load()}
+}
+
+// ClientIdentity is the identity of the verified certificate of a client.
+type ClientIdentity struct {
+	Subject        string
+	CommonName     string
+	SerialNumber   string
+	DNSNames       []string
+	EmailAddresses []string
+	URIs           []string
+	Certificate    *x509.Certificate
+}
+
+// ClientIdentityFromRequest returns the identity of the client certificate of
+// r, ok is false unless the certificate was verified, which needs
+// ClientAuthVerify on the server. Gin handlers pass c.Request.
+func ClientIdentityFromRequest(r *http.Request) (*ClientIdentity, bool) {
+	if r == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	id := &ClientIdentity{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		SerialNumber:   cert.SerialNumber.String(),
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		Certificate:    cert,
+	}
+	for _, uri := range cert.URIs {
+		id.URIs = append(id.URIs, uri.String())
+	}
+
+	return id, true
+}
+
+func (a *app) _run_tls(ctx *AppContext) error {
+	files := a.certs.files()
+	if len(files) == 0 {
+		return nil
+	}
+
+	interval := a.features.TLS.ReloadInterval
+	if interval <= 0 {
+		interval = defaultCertReloadInterval
+	}
+
+	a.l.Info("[Running TLS] watching certificate files", zap.Strings("files", files))
+	watchCtx, cancel := context.WithCancel(context.Background())
+	done := watchFiles(watchCtx, func() []string { return files }, interval, func() {
+		a.l.Info("[TLS] certificate files changed, reloading")
+		_ = a._reload_tls(ctx)
+	})
+	a.stopCertWatch = func() {
+		cancel()
+		<-done
+	}
+
+	return nil
+}
+
+func (a *app) _reload_tls(ctx *AppContext) error {
+	if err := a.certs.reload(); err != nil {
+		a.l.Error("[TLS] failed to reload certificate, keeping the current one", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func (a *app) _stop_tls(ctx context.Context) error {
+	if a.stopCertWatch != nil {
+		a.stopCertWatch()
+		a.stopCertWatch = nil
+	}
+
+	return a._stop_server(acmeServerName)(ctx)
+}
+
+// _set_cert_expiry exposes the expiry of the certificate in use.
+func (a *app) _set_cert_expiry(leaf *x509.Certificate) {
+	a.state.set(func(s *AppState) { s.TLSCertificateExpiry = leaf.NotAfter })
+}
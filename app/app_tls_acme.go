@@ -0,0 +1,76 @@
+package app
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeServerName is the name of the plain HTTP server of the HTTP-01 challenges.
+const acmeServerName = "acme"
+
+// acmeChallengePath is where HTTP-01 challenges are served.
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// _acme_manager returns the manager that obtains and renews the certificates
+// of the ACME domains of the TLS feature.
+func (a *app) _acme_manager(ctx *AppContext) *autocert.Manager {
+	f := a.features.TLS.ACME
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(f.Domains...),
+		Email:      f.Email,
+		Client:     &acme.Client{DirectoryURL: f.DirectoryURL},
+	}
+
+	if f.CacheDir != "" {
+		ctx.L().Info("[Startup TLS] caching ACME certificates", zap.String("dir", f.CacheDir))
+		m.Cache = autocert.DirCache(f.CacheDir)
+	}
+
+	return m
+}
+
+// _startup_acme lets the ACME client trust the CAs of the TLS feature and
+// serves the HTTP-01 challenges on the HTTP mux, the Gin engine and, with an
+// ACME http port, on a plain HTTP listener of their own.
+func (a *app) _startup_acme(ctx *AppContext) error {
+	l := ctx.L()
+	f := a.features.TLS.ACME
+	if len(f.Domains) == 0 {
+		return fmt.Errorf("ACME needs at least one domain")
+	}
+
+	m := a.certs.acme
+	m.Client.HTTPClient = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: a.certs.pool.Load()},
+		},
+	}
+
+	challenges := m.HTTPHandler(http.NotFoundHandler())
+	if a.features.HTTP.Enabled {
+		l.Debug("[Startup TLS] serving ACME challenges on the http mux")
+		a.features.HTTP.Mux.Handle(acmeChallengePath, challenges)
+	}
+
+	if a.features.Gin.Enabled {
+		l.Debug("[Startup TLS] serving ACME challenges on the gin engine")
+		a.features.Gin.Engine.GET(acmeChallengePath+"*token", gin.WrapH(challenges))
+	}
+
+	if f.HTTPPort == 0 {
+		return nil
+	}
+
+	l.Info("[Startup TLS] serving ACME challenges over http", zap.Int("port", f.HTTPPort))
+	return a._serve(ctx, &http.Server{
+		Addr:    fmt.Sprintf("0.0.0.0:%d", f.HTTPPort),
+		Handler: m.HTTPHandler(nil),
+	}, acmeServerName)
+}
@@ -0,0 +1,247 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	devCAFile   = "ca.pem"
+	devCertFile = "cert.pem"
+	devKeyFile  = "key.pem"
+
+	devCAValidity   = 365 * 24 * time.Hour
+	devCertValidity = 90 * 24 * time.Hour
+	// devCertRenewBefore is how long before its expiry a written certificate
+	// is replaced instead of reused.
+	devCertRenewBefore = 7 * 24 * time.Hour
+)
+
+// devCertHosts returns localhost and the loopback addresses followed by hosts.
+func devCertHosts(hosts []string) []string {
+	all := []string{"localhost", "127.0.0.1", "::1"}
+	seen := map[string]bool{}
+	for _, h := range all {
+		seen[h] = true
+	}
+
+	for _, h := range hosts {
+		if !seen[h] {
+			seen[h] = true
+			all = append(all, h)
+		}
+	}
+
+	return all
+}
+
+// devCerts holds the pem encoded certificates of a development CA and a
+// server certificate signed by it.
+type devCerts struct {
+	ca   []byte
+	cert []byte
+	key  []byte
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// generateDevCerts creates a CA and a server certificate for hosts, both only
+// exist in memory until they are written.
+func generateDevCerts(hosts []string) (*devCerts, error) {
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ca key: %v", err)
+	}
+
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "go-app development CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(devCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ca certificate: %v", err)
+	}
+
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ca certificate: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate server key: %v", err)
+	}
+
+	serial, err = newSerialNumber()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(devCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create server certificate: %v", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal server key: %v", err)
+	}
+
+	return &devCerts{
+		ca:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		key:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// readDevCerts reads the certificates written to dir. ok is false when they
+// are missing, invalid, do not cover hosts or expire soon.
+func readDevCerts(dir string, hosts []string) (certs *devCerts, ok bool) {
+	certs = &devCerts{}
+	for path, b := range map[string]*[]byte{
+		filepath.Join(dir, devCAFile):   &certs.ca,
+		filepath.Join(dir, devCertFile): &certs.cert,
+		filepath.Join(dir, devKeyFile):  &certs.key,
+	} {
+		var err error
+		if *b, err = os.ReadFile(path); err != nil {
+			return nil, false
+		}
+	}
+
+	pair, err := tls.X509KeyPair(certs.cert, certs.key)
+	if err != nil {
+		return nil, false
+	}
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil || time.Now().Add(devCertRenewBefore).After(leaf.NotAfter) {
+		return nil, false
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certs.ca) {
+		return nil, false
+	}
+
+	for _, h := range hosts {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: h, Roots: pool}); err != nil {
+			return nil, false
+		}
+	}
+
+	return certs, true
+}
+
+// write writes the certificates to dir, the key is only readable by the owner.
+func (c *devCerts) write(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create dev cert dir %s: %v", dir, err)
+	}
+
+	for name, file := range map[string]struct {
+		b    []byte
+		mode os.FileMode
+	}{
+		devCAFile:   {c.ca, 0644},
+		devCertFile: {c.cert, 0644},
+		devKeyFile:  {c.key, 0600},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), file.b, file.mode); err != nil {
+			return fmt.Errorf("failed to write %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// _startup_dev_certs generates the development certificates of the TLS
+// feature, or reuses the ones written to its DevCertDir, and uses them as
+// the server certificate and an additional CA.
+func (a *app) _startup_dev_certs(ctx *AppContext) error {
+	l := ctx.L()
+	f := &a.features.TLS
+	hosts := devCertHosts(f.DevCertHosts)
+
+	var certs *devCerts
+	ok := false
+	if f.DevCertDir != "" {
+		certs, ok = readDevCerts(f.DevCertDir, hosts)
+		if ok {
+			l.Info("[Startup TLS] reusing development certificates", zap.String("dir", f.DevCertDir))
+		}
+	}
+
+	if !ok {
+		l.Info("[Startup TLS] generating development certificates", zap.Strings("hosts", hosts))
+		var err error
+		certs, err = generateDevCerts(hosts)
+		if err != nil {
+			return err
+		}
+
+		if f.DevCertDir != "" {
+			if err := certs.write(f.DevCertDir); err != nil {
+				return err
+			}
+			l.Info("[Startup TLS] wrote development certificates", zap.String("dir", f.DevCertDir))
+		}
+	}
+
+	ca := append([]byte{}, f.CABytes...)
+	if len(ca) == 0 && f.CAFile != "" {
+		b, err := os.ReadFile(f.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read ca file %s: %v", f.CAFile, err)
+		}
+		ca = append(b, '\n')
+	}
+
+	f.CABytes = append(ca, certs.ca...)
+	f.ServerCertBytes = certs.cert
+	f.ServerKeyBytes = certs.key
+	return nil
+}
@@ -0,0 +1,154 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// _span_exporter creates the exporter configured in the tracing feature.
+func (a *app) _span_exporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	f := a.features.Tracing
+	if f.SpanExporter != nil {
+		return f.SpanExporter, nil
+	}
+
+	switch f.Exporter {
+	case TracingExporterOTLP, "":
+		opts := []otlptracehttp.Option{}
+		if f.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(f.Endpoint))
+		}
+		if f.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	case TracingExporterStdout:
+		return stdouttrace.New()
+	case TracingExporterFile:
+		if f.File == "" {
+			return nil, fmt.Errorf("tracing file exporter needs a file")
+		}
+		file, err := os.OpenFile(f.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open tracing file: %v", err)
+		}
+		a.tracingFile = file
+		return stdouttrace.New(stdouttrace.WithWriter(file))
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %s", f.Exporter)
+	}
+}
+
+// spanName names the server spans of the http mux after the matched route.
+func spanName(operation string, r *http.Request) string {
+	if r.Pattern == "" {
+		return r.Method
+	}
+
+	return r.Method + " " + strings.TrimPrefix(r.Pattern, r.Method+" ")
+}
+
+func (a *app) _startup_tracing(ctx *AppContext) error {
+	l := a.l
+	f := a.features.Tracing
+
+	exporter, err := a._span_exporter(ctx)
+	if err != nil {
+		return err
+	}
+
+	name := orDefault(f.ServiceName, a.appName)
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", name))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(f.SampleRatio))),
+	)
+	propagator := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagator)
+	a.tracerProvider = tp
+	l.Info("[Startup Tracing] tracing enabled", zap.String("service", name), zap.String("exporter", f.Exporter))
+
+	if a.features.Gin.Enabled {
+		l.Debug("[Startup Tracing] tracing gin engine")
+		a.features.Gin.Engine.Use(otelgin.Middleware(name,
+			otelgin.WithTracerProvider(tp),
+			otelgin.WithPropagators(propagator),
+		))
+	}
+
+	if a.features.HTTP.Enabled {
+		l.Debug("[Startup Tracing] tracing http mux")
+		a._use_http(func(next http.Handler) http.Handler {
+			return otelhttp.NewHandler(next, name,
+				otelhttp.WithTracerProvider(tp),
+				otelhttp.WithPropagators(propagator),
+				otelhttp.WithSpanNameFormatter(spanName),
+			)
+		})
+	}
+
+	a._use_client(func(next http.RoundTripper) http.RoundTripper {
+		return otelhttp.NewTransport(next, otelhttp.WithTracerProvider(tp), otelhttp.WithPropagators(propagator))
+	})
+
+	ctx.tracer = tp.Tracer(name)
+	ctx.Context, a.startupSpan = ctx.tracer.Start(ctx.Context, "startup")
+
+	return nil
+}
+
+// _detach_startup_span removes the startup span from the app context, spans
+// started by the run hooks and the running hook are new traces. It is called
+// before the run hooks start goroutines that read the app context.
+func (a *app) _detach_startup_span(ctx *AppContext) {
+	if a.startupSpan == nil {
+		return
+	}
+
+	ctx.Context = trace.ContextWithSpan(ctx.Context, trace.SpanFromContext(context.Background()))
+}
+
+// _end_startup_span ends the startup span, it does not touch the app context
+// that the running goroutines share.
+func (a *app) _end_startup_span(err error) {
+	if a.startupSpan == nil {
+		return
+	}
+
+	if err != nil {
+		a.startupSpan.RecordError(err)
+		a.startupSpan.SetStatus(codes.Error, err.Error())
+	}
+	a.startupSpan.End()
+	a.startupSpan = nil
+}
+
+// _stop_tracing flushes the pending spans and shuts the exporter down.
+func (a *app) _stop_tracing(ctx context.Context) error {
+	err := a.tracerProvider.Shutdown(ctx)
+	if a.tracingFile != nil {
+		if closeErr := a.tracingFile.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		a.tracingFile = nil
+	}
+
+	return err
+}
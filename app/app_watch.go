@@ -0,0 +1,61 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"time"
+)
+
+// fileHashes returns the sha256 of the content of every path, missing files
+// have an empty hash.
+func fileHashes(paths []string) map[string][sha256.Size]byte {
+	hashes := map[string][sha256.Size]byte{}
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			hashes[path] = [sha256.Size]byte{}
+			continue
+		}
+		hashes[path] = sha256.Sum256(b)
+	}
+
+	return hashes
+}
+
+// watchFiles polls paths every interval and calls onChange when the content
+// of one of them changed, until ctx is done. Polling the content also sees
+// files that are replaced through symlinks, like mounted kubernetes secrets.
+// paths is called on every poll, files that were not watched before are not
+// reported as changed. The returned channel is closed once the watcher stopped.
+func watchFiles(ctx context.Context, paths func() []string, interval time.Duration, onChange func()) <-chan struct{} {
+	done := make(chan struct{})
+	hashes := fileHashes(paths())
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				current := fileHashes(paths())
+				changed := false
+				for path, hash := range current {
+					if prev, ok := hashes[path]; ok && prev != hash {
+						changed = true
+						break
+					}
+				}
+				hashes = current
+				if changed {
+					onChange()
+				}
+			}
+		}
+	}()
+
+	return done
+}
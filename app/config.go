@@ -1 +1,454 @@
 package app
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// Sources of the values of an effective config.
+const (
+	ConfigSourceDefault = "default"
+	ConfigSourceFile    = "file"
+	ConfigSourceEnv     = "env"
+	ConfigSourceFlag    = "flag"
+)
+
+// DefaultEnvPrefix is the prefix of the environment variables that override
+// config values, e.g. APP_GIN_PORT sets gin.port.
+const DefaultEnvPrefix = "APP"
+
+// configFlags maps the flags registered in init to the config keys they set.
+var configFlags = map[string]string{
+	"registry":        "registry.path",
+	"sql-files":       "sql.sql_files",
+	"rsa-private-key": "rsa.private_key_path",
+	"rsa-public-key":  "rsa.public_key_path",
+	"jwt-private-key": "jwt.rsa_key_path",
+	"jwt-public-key":  "jwt.rsa_pub_key_path",
+	"tls-key-path":    "tls.key_file",
+	"tls-cert-path":   "tls.cert_file",
+	"tls-ca-path":     "tls.ca_path",
+	"health-path":     "health.path",
+	"docs-port":       "docs.docs_port",
+	"docs-path":       "docs.docs_dir",
+	"docs-api-path":   "docs.docs_api_path",
+}
+
+// configFilesFlag and configSetFlag are the -config and -set flags.
+var (
+	configFilesFlag stringsFlag
+	configSetFlag   stringsFlag
+)
+
+// stringsFlag is a flag that can be given more than once.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// DefaultConfig returns the config the loader starts from, it matches the
+// defaults of the feature constructors.
+func DefaultConfig() *AppConfig {
+	return &AppConfig{
+		Gin: GinConfig{Port: 8080},
+		DocsConfig: DocsConfig{
+			DocsApiPath: "/api/docs",
+			DocsDir:     "/docs/",
+		},
+		Health: HealthConfig{
+			Interval:      30,
+			LivenessPath:  DefaultLivenessPath,
+			ReadinessPath: DefaultReadinessPath,
+			StartupPath:   DefaultStartupPath,
+		},
+		Metrics: MetricsConfig{Path: DefaultMetricsPath},
+		Tracing: TracingConfig{Exporter: TracingExporterOTLP},
+	}
+}
+
+const (
+	configLoader_filesOpt    string = "opt-config-files"
+	configLoader_envOpt      string = "opt-config-env-prefix"
+	configLoader_flagsOpt    string = "opt-config-flags"
+	configLoader_defaultsOpt string = "opt-config-defaults"
+	configLoader_secretsOpt  string = "opt-config-secret-resolver"
+)
+
+type configLoaderOpt struct {
+	featureOpt
+}
+
+// WithConfigFiles adds config files, later files override earlier ones.
+func WithConfigFiles(paths ...string) configLoaderOpt {
+	return configLoaderOpt{featureOpt: featureOpt{key: configLoader_filesOpt, value: paths}}
+}
+
+// WithEnvPrefix sets the prefix of the environment variables, empty disables them.
+func WithEnvPrefix(prefix string) configLoaderOpt {
+	return configLoaderOpt{featureOpt: featureOpt{key: configLoader_envOpt, value: prefix}}
+}
+
+// WithFlagSet reads the flags from fs instead of the command line, nil
+// disables them. fs has to be parsed already.
+func WithFlagSet(fs *flag.FlagSet) configLoaderOpt {
+	return configLoaderOpt{featureOpt: featureOpt{key: configLoader_flagsOpt, value: fs}}
+}
+
+// WithConfigDefaults starts from cfg instead of DefaultConfig.
+func WithConfigDefaults(cfg *AppConfig) configLoaderOpt {
+	return configLoaderOpt{featureOpt: featureOpt{key: configLoader_defaultsOpt, value: cfg}}
+}
+
+type secretResolverOpt struct {
+	scheme   string
+	resolver SecretResolver
+}
+
+// WithSecretResolver resolves the secret references of scheme with r, e.g.
+// ${vault:db/password} with the scheme vault. It replaces the resolver of the
+// env and file schemes when scheme is one of them.
+func WithSecretResolver(scheme string, r SecretResolver) configLoaderOpt {
+	return configLoaderOpt{featureOpt: featureOpt{key: configLoader_secretsOpt, value: secretResolverOpt{scheme: scheme, resolver: r}}}
+}
+
+// ConfigLoader builds an AppConfig from layers, every layer overrides the
+// previous ones: defaults, config files, environment variables and flags.
+// Secret references in the values are resolved once all layers are applied.
+type ConfigLoader struct {
+	files     []string
+	envPrefix string
+	flags     *flag.FlagSet
+	defaults  *AppConfig
+	resolvers map[string]SecretResolver
+}
+
+func (l *ConfigLoader) apply(opt configLoaderOpt) {
+	switch opt.key {
+	case configLoader_filesOpt:
+		l.files = append(l.files, opt.value.([]string)...)
+	case configLoader_envOpt:
+		l.envPrefix = opt.value.(string)
+	case configLoader_flagsOpt:
+		l.flags = opt.value.(*flag.FlagSet)
+	case configLoader_defaultsOpt:
+		l.defaults = opt.value.(*AppConfig)
+	case configLoader_secretsOpt:
+		o := opt.value.(secretResolverOpt)
+		l.resolvers[o.scheme] = o.resolver
+	}
+}
+
+func NewConfigLoader(opts ...configLoaderOpt) *ConfigLoader {
+	l := &ConfigLoader{
+		envPrefix: DefaultEnvPrefix,
+		flags:     flag.CommandLine,
+		resolvers: defaultSecretResolvers(),
+	}
+
+	for _, opt := range opts {
+		l.apply(opt)
+	}
+
+	return l
+}
+
+// EffectiveConfig is a loaded config together with the source of every value.
+type EffectiveConfig struct {
+	Config *AppConfig
+	// Sources maps the key of every value, e.g. gin.port, to the layer that
+	// set it, e.g. env:APP_GIN_PORT.
+	Sources map[string]string
+	keys    []string
+}
+
+// Source returns the layer that set the value of key.
+func (c *EffectiveConfig) Source(key string) string {
+	return c.Sources[key]
+}
+
+// Dump writes every value of the config with the layer that set it, values
+// resolved from secret references are redacted.
+func (c *EffectiveConfig) Dump(w io.Writer) error {
+	values := map[string]reflect.Value{}
+	for _, f := range configFields(c.Config.Redacted()) {
+		values[f.key] = f.value
+	}
+
+	for _, key := range c.keys {
+		b, err := json.Marshal(values[key].Interface())
+		if err != nil {
+			return fmt.Errorf("failed to dump %s: %v", key, err)
+		}
+		source := c.Sources[key]
+		if c.Config.IsSecret(key) {
+			source += ", secret"
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s # %s\n", key, b, source); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Files returns the config files in the order they are layered.
+func (l *ConfigLoader) Files() []string {
+	files := append([]string{}, l.files...)
+	if l.flags == flag.CommandLine {
+		files = append(files, configFilesFlag...)
+	}
+
+	return files
+}
+
+// Load builds the config from all layers.
+func (l *ConfigLoader) Load() (*EffectiveConfig, error) {
+	cfg := DefaultConfig()
+	if l.defaults != nil {
+		cfg = l.defaults.clone()
+	}
+
+	fields := configFields(cfg)
+	ec := &EffectiveConfig{Config: cfg, Sources: map[string]string{}}
+	byKey := map[string]reflect.Value{}
+	for _, f := range fields {
+		ec.keys = append(ec.keys, f.key)
+		ec.Sources[f.key] = ConfigSourceDefault
+		byKey[f.key] = f.value
+	}
+
+	positions := map[string]string{}
+	if l.flags == flag.CommandLine && !flag.Parsed() {
+		flag.Parse()
+	}
+
+	for _, path := range l.Files() {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+
+		for key, line := range yamlLines(b) {
+			if _, ok := byKey[key]; ok {
+				ec.Sources[key] = ConfigSourceFile + ":" + path
+				positions[key] = fmt.Sprintf("%s:%d", path, line)
+			}
+		}
+	}
+
+	if l.envPrefix != "" {
+		for _, f := range fields {
+			name := envName(l.envPrefix, f.key)
+			v, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+
+			if err := setConfigValue(f.value, v); err != nil {
+				return nil, fmt.Errorf("invalid value of %s: %v", name, err)
+			}
+			ec.Sources[f.key] = ConfigSourceEnv + ":" + name
+			positions[f.key] = ec.Sources[f.key]
+		}
+	}
+
+	if l.flags != nil {
+		var err error
+		l.flags.Visit(func(fl *flag.Flag) {
+			if err != nil {
+				return
+			}
+
+			key, ok := configFlags[fl.Name]
+			if !ok {
+				return
+			}
+			if err = setConfigValue(byKey[key], fl.Value.String()); err != nil {
+				err = fmt.Errorf("invalid value of -%s: %v", fl.Name, err)
+				return
+			}
+			ec.Sources[key] = ConfigSourceFlag + ":" + fl.Name
+			positions[key] = ec.Sources[key]
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if l.flags == flag.CommandLine {
+			for _, set := range configSetFlag {
+				key, v, ok := strings.Cut(set, "=")
+				value, known := byKey[key]
+				if !ok || !known {
+					return nil, fmt.Errorf("invalid -set %s, expected a known key=value", set)
+				}
+				if err := setConfigValue(value, v); err != nil {
+					return nil, fmt.Errorf("invalid value of -set %s: %v", key, err)
+				}
+				ec.Sources[key] = ConfigSourceFlag + ":set"
+				positions[key] = ec.Sources[key]
+			}
+		}
+	}
+
+	cfg.positions = positions
+	if err := cfg.resolveSecrets(l.resolvers); err != nil {
+		return nil, err
+	}
+
+	return ec, nil
+}
+
+// configField is a value of the config with its dotted yaml key.
+type configField struct {
+	key   string
+	value reflect.Value
+}
+
+// configFields returns the values of cfg, nested config structs are
+// flattened into dotted keys, e.g. gin.cors.origins.
+func configFields(cfg *AppConfig) []configField {
+	return structFields("", reflect.ValueOf(cfg).Elem())
+}
+
+// clone returns a deep copy of cfg, so resolving the secrets of the copy does
+// not change cfg.
+func (cfg *AppConfig) clone() *AppConfig {
+	return cloneValue(reflect.ValueOf(cfg)).Interface().(*AppConfig)
+}
+
+// cloneValue returns a deep copy of v, unexported fields are copied shallow.
+func cloneValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(cloneValue(v.Elem()))
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(cloneValue(v.Index(i)))
+		}
+		return c
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(cloneValue(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, k := range v.MapKeys() {
+			c.SetMapIndex(k, cloneValue(v.MapIndex(k)))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < c.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(cloneValue(v.Field(i)))
+			}
+		}
+		return c
+	}
+
+	return v
+}
+
+func structFields(prefix string, v reflect.Value) []configField {
+	fields := []configField{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		key := prefix + name
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			fields = append(fields, structFields(key+".", fv)...)
+			continue
+		}
+		fields = append(fields, configField{key: key, value: fv})
+	}
+
+	return fields
+}
+
+// yamlLines returns the dotted keys set in a yaml document with their line.
+func yamlLines(b []byte) map[string]int {
+	lines := map[string]int{}
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(b, &doc); err != nil || len(doc.Content) == 0 {
+		return lines
+	}
+
+	var walk func(prefix string, n *yamlv3.Node)
+	walk = func(prefix string, n *yamlv3.Node) {
+		if n.Kind != yamlv3.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := prefix + n.Content[i].Value
+			lines[key] = n.Content[i].Line
+			walk(key+".", n.Content[i+1])
+		}
+	}
+	walk("", doc.Content[0])
+
+	return lines
+}
+
+// envName returns the environment variable of a config key.
+func envName(prefix, key string) string {
+	return prefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// setConfigValue parses s into v. Lists of strings are comma separated, other
+// non string values are parsed as yaml.
+func setConfigValue(v reflect.Value, s string) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		values := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = reflect.Append(values, reflect.ValueOf(item).Convert(v.Type().Elem()))
+			}
+		}
+		v.Set(values)
+		return nil
+	default:
+		return yaml.Unmarshal([]byte(s), v.Addr().Interface())
+	}
+}
@@ -6,4 +6,18 @@ var (
 	ErrRegistryFileNotFound error = fmt.Errorf("registry file not found")
 	ErrPrivateKeyNotFound error = fmt.Errorf("private key not found")
 	ErrPublicKeyNotFound error = fmt.Errorf("public key not found") 
-)
\ No newline at end of file
+)
+
+// FeatureStopError is returned by Run for every feature that failed to stop cleanly.
+type FeatureStopError struct {
+	Feature string
+	Err     error
+}
+
+func (e *FeatureStopError) Error() string {
+	return fmt.Sprintf("failed to stop feature %s: %v", e.Feature, e.Err)
+}
+
+func (e *FeatureStopError) Unwrap() error {
+	return e.Err
+}
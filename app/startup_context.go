@@ -2,8 +2,12 @@ package app
 
 import (
 	"context"
+	"net/http"
+	"sync"
 
 	"github.com/ooqls/go-crypto/jwt"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
 	"go.uber.org/zap"
 )
 
@@ -23,19 +27,78 @@ func NewAppContext(ctx context.Context, l *zap.Logger) *AppContext {
 type AppContext struct {
 	context.Context
 	l                    *zap.Logger
+	tokenM               sync.RWMutex
 	issuerToTokenConfigs map[string]jwt.TokenConfiguration
+	tracer               trace.Tracer
+	httpClient           *http.Client
+	jwtKeys              *jwtKeys
 }
 
 func (ctx *AppContext) L() *zap.Logger {
 	return ctx.l
 }
 
+// HTTPClient returns the http client of the app. It trusts the CA of the TLS
+// feature and forwards the trace context and the request ID of the request
+// context. The client is available once the app is running.
+func (ctx *AppContext) HTTPClient() *http.Client {
+	if ctx.httpClient == nil {
+		return http.DefaultClient
+	}
+
+	return ctx.httpClient
+}
+
 func (ctx *AppContext) AuthIssuerConfig() (*jwt.TokenConfiguration, bool) {
-	config, ok := ctx.issuerToTokenConfigs[AuthIssuer]
-	return &config, ok
+	return ctx.TokenConfig(AuthIssuer)
 }
 
 func (ctx *AppContext) RefreshIssuerConfig() (*jwt.TokenConfiguration, bool) {
-	config, ok := ctx.issuerToTokenConfigs[RefreshIssuer]
+	return ctx.TokenConfig(RefreshIssuer)
+}
+
+// TokenConfig returns the token configuration of issuer. The configurations
+// can change when the config is reloaded, it is safe to call concurrently.
+func (ctx *AppContext) TokenConfig(issuer string) (*jwt.TokenConfiguration, bool) {
+	ctx.tokenM.RLock()
+	defer ctx.tokenM.RUnlock()
+
+	config, ok := ctx.issuerToTokenConfigs[issuer]
 	return &config, ok
 }
+
+// tokenConfigs returns the token configurations by issuer, the map is
+// replaced and not changed by setTokenConfigs.
+func (ctx *AppContext) tokenConfigs() map[string]jwt.TokenConfiguration {
+	ctx.tokenM.RLock()
+	defer ctx.tokenM.RUnlock()
+
+	return ctx.issuerToTokenConfigs
+}
+
+// setTokenConfigs replaces the token configurations.
+func (ctx *AppContext) setTokenConfigs(configs map[string]jwt.TokenConfiguration) {
+	ctx.tokenM.Lock()
+	defer ctx.tokenM.Unlock()
+
+	ctx.issuerToTokenConfigs = configs
+}
+
+// Tracer returns the tracer of the app, it records nothing when tracing is disabled.
+func (ctx *AppContext) Tracer() trace.Tracer {
+	if ctx.tracer == nil {
+		return tracenoop.NewTracerProvider().Tracer("")
+	}
+
+	return ctx.tracer
+}
+
+// Span returns the active span, the startup span while the app is starting.
+func (ctx *AppContext) Span() trace.Span {
+	return trace.SpanFromContext(ctx)
+}
+
+// StartSpan starts a child span of the active span.
+func (ctx *AppContext) StartSpan(name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return ctx.Tracer().Start(ctx, name, opts...)
+}